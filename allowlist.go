@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"thesis/sqlparser"
+	"thesis/store"
+)
+
+// Modes of the query allowlist, chosen with ALLOWLIST_MODE. Admins are never
+// held to it.
+const (
+	AllowlistOff     = "off"     // fingerprints are neither recorded nor checked
+	AllowlistLearn   = "learn"   // a fingerprint a user sends is allowed for that user from then on, until ALLOWLIST_LEARN_FOR is up
+	AllowlistAlert   = "alert"   // fingerprints not allowed are logged and let through
+	AllowlistEnforce = "enforce" // fingerprints not allowed are refused
+)
+
+const (
+	// recordFingerprintTimeout bounds storing a fingerprint sent for the first time
+	recordFingerprintTimeout = 5 * time.Second
+
+	// fingerprintQueueSize is how many new fingerprints may wait to be stored;
+	// ones sent while the queue is full are recorded the next time they are sent
+	fingerprintQueueSize = 1024
+)
+
+// Statuses of a fingerprint in the allowlist
+const (
+	FingerprintAllowed = "allowed"
+	FingerprintPending = "pending" // first sent outside learning, waiting for approval
+	FingerprintRevoked = "revoked"
+)
+
+func validAllowlistMode(mode string) bool {
+	return mode == AllowlistOff || mode == AllowlistLearn || mode == AllowlistAlert || mode == AllowlistEnforce
+}
+
+// allowlistKey names the entry of one user for one fingerprint
+type allowlistKey struct {
+	user        string
+	fingerprint string
+}
+
+// allowlist holds the status of every fingerprint in the store, kept up to
+// date as fingerprints are recorded, approved and revoked. A fingerprint
+// sent for the first time is added at once and stored in the background by
+// recordFingerprints.
+type allowlist struct {
+	lock       sync.RWMutex
+	entries    map[allowlistKey]string
+	pending    map[string]int            // fingerprints of each user waiting for approval
+	queue      chan store.AllowlistEntry // new fingerprints waiting to be stored
+	learnUntil time.Time                 // when learn mode stops learning, zero for never
+}
+
+func (a *allowlist) status(user, fingerprint string) (string, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	status, ok := a.entries[allowlistKey{user: user, fingerprint: fingerprint}]
+
+	return status, ok
+}
+
+func (a *allowlist) set(entry store.AllowlistEntry) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.put(allowlistKey{user: entry.ProxyUser, fingerprint: entry.Fingerprint}, entry.Status)
+}
+
+// put sets the status of key, or removes it for an empty status, keeping
+// count of the pending ones. The caller must hold a.lock.
+func (a *allowlist) put(key allowlistKey, status string) {
+	if a.entries == nil {
+		a.entries = make(map[allowlistKey]string)
+		a.pending = make(map[string]int)
+	}
+
+	if a.entries[key] == FingerprintPending {
+		a.pending[key.user]--
+	}
+
+	if status == "" {
+		delete(a.entries, key)
+		return
+	}
+
+	if status == FingerprintPending {
+		a.pending[key.user]++
+	}
+
+	a.entries[key] = status
+}
+
+// claim adds the fingerprint of key with status unless it is there already,
+// returning the status it has and whether it was added and has to be stored.
+// A pending fingerprint is not added when the user already has maxPending
+// waiting for approval, 0 meaning no limit.
+func (a *allowlist) claim(key allowlistKey, status string, maxPending int) (string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if current, ok := a.entries[key]; ok {
+		return current, false
+	}
+
+	if status == FingerprintPending && maxPending > 0 && a.pending[key.user] >= maxPending {
+		return status, false
+	}
+
+	a.put(key, status)
+
+	return status, true
+}
+
+// learning reports whether learn mode still allows the fingerprints users send
+func (a *allowlist) learning(now time.Time) bool {
+	return a.learnUntil.IsZero() || now.Before(a.learnUntil)
+}
+
+// loadAllowlist reads the allowlist from the store
+func (p *Proxy) loadAllowlist(ctx context.Context, requestID uuid.UUID) error {
+	entries, err := p.store.allowlistStore.GetAll(ctx, requestID)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		p.allowlist.set(entry)
+	}
+
+	return nil
+}
+
+// allowlistQuery looks up the fingerprint of every statement of query in the
+// allowlist of the session's user, recording the ones sent for the first
+// time. In enforce mode it returns the ErrorResponse to send the client when
+// one is not allowed, refusing the query string as a whole.
+func (p *Proxy) allowlistQuery(session *Session, query string) []byte {
+	mode := p.config.allowlistMode
+	if mode == AllowlistOff || session.role == UserRoleAdmin || len(query) == 0 {
+		return nil
+	}
+
+	// once learning is over, new fingerprints wait for approval
+	if mode == AllowlistLearn && !p.allowlist.learning(time.Now()) {
+		mode = AllowlistAlert
+	}
+
+	statements, refused := parseQuery(query)
+	if refused != nil {
+		return refused
+	}
+
+	var denied []byte
+
+	for _, statement := range statements {
+		status, ok := p.allowlist.status(session.username, statement.Fingerprint)
+		if !ok {
+			status = FingerprintPending
+			if mode == AllowlistLearn {
+				status = FingerprintAllowed
+			}
+
+			status = p.recordFingerprint(session, statement, status)
+		}
+
+		if status == FingerprintAllowed || mode == AllowlistLearn {
+			continue
+		}
+
+		p.logger.Warn().Msgf("FROM-CLIENT; [Conn %d] Query fingerprint %s of %s is %s in the allowlist: %s",
+			session.request.connID, statement.Fingerprint, session.username, status, statement.Normalized)
+
+		if mode == AllowlistEnforce && denied == nil {
+			denied = encodeError("ERROR", "42501", fmt.Sprintf("query fingerprint %s is not in the allowlist of %s", statement.Fingerprint, session.username))
+		}
+	}
+
+	return denied
+}
+
+// recordFingerprint adds the fingerprint of statement to the allowlist of the
+// session's user with status, unless it got there in the meantime, and
+// returns the status it has. The fingerprint is stored in the background; a
+// user with ALLOWLIST_MAX_PENDING fingerprints waiting for approval has new
+// ones treated as pending without recording them.
+func (p *Proxy) recordFingerprint(session *Session, statement sqlparser.Statement, status string) string {
+	key := allowlistKey{user: session.username, fingerprint: statement.Fingerprint}
+
+	status, claimed := p.allowlist.claim(key, status, p.config.allowlistMaxPending)
+	if !claimed {
+		return status
+	}
+
+	entry := store.AllowlistEntry{
+		ID:          uuid.New(),
+		ProxyUser:   session.username,
+		Fingerprint: statement.Fingerprint,
+		Query:       statement.Normalized,
+		Status:      status,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	select {
+	case p.allowlist.queue <- entry:
+	default:
+		// tried again the next time it is sent
+		p.allowlist.forget(key)
+		p.logger.Warn().Msgf("[Conn %d] Too many query fingerprints waiting to be stored; not recording %s", session.request.connID, statement.Fingerprint)
+	}
+
+	return status
+}
+
+// forget drops a fingerprint that could not be stored, so that it is
+// recorded again the next time it is sent
+func (a *allowlist) forget(key allowlistKey) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.put(key, "")
+}
+
+// recordFingerprints stores the fingerprints recordFingerprint queues, until
+// the proxy shuts down. The store keeps an entry recorded in the meantime,
+// whose status then replaces the one the fingerprint was added with.
+func (p *Proxy) recordFingerprints() {
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case entry := <-p.allowlist.queue:
+			ctx, cancel := context.WithTimeout(p.ctx, recordFingerprintTimeout)
+			stored, err := p.store.allowlistStore.Record(ctx, uuid.New(), entry)
+			cancel()
+
+			if err != nil {
+				p.logger.Error().Err(err).Msgf("Failed to record query fingerprint %s of %s", entry.Fingerprint, entry.ProxyUser)
+				p.allowlist.forget(allowlistKey{user: entry.ProxyUser, fingerprint: entry.Fingerprint})
+
+				continue
+			}
+
+			p.allowlist.set(*stored)
+		}
+	}
+}
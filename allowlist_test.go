@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"thesis/store"
+)
+
+func TestAllowlistMaxPending(t *testing.T) {
+	var list allowlist
+
+	for i, fingerprint := range []string{"a", "b", "c"} {
+		status, claimed := list.claim(allowlistKey{user: "app", fingerprint: fingerprint}, FingerprintPending, 2)
+		if status != FingerprintPending || claimed != (i < 2) {
+			t.Errorf("claim %s = %s, %v", fingerprint, status, claimed)
+		}
+	}
+
+	// allowed fingerprints and other users are not held to the limit
+	if _, claimed := list.claim(allowlistKey{user: "app", fingerprint: "d"}, FingerprintAllowed, 2); !claimed {
+		t.Error("allowed fingerprint was not claimed")
+	}
+
+	if _, claimed := list.claim(allowlistKey{user: "other", fingerprint: "a"}, FingerprintPending, 2); !claimed {
+		t.Error("another user's fingerprint was not claimed")
+	}
+
+	// approving one makes room for the next
+	list.set(store.AllowlistEntry{ProxyUser: "app", Fingerprint: "a", Status: FingerprintAllowed})
+
+	if _, claimed := list.claim(allowlistKey{user: "app", fingerprint: "c"}, FingerprintPending, 2); !claimed {
+		t.Error("fingerprint was not claimed after another was approved")
+	}
+
+	// a fingerprint that could not be stored is claimed again
+	list.forget(allowlistKey{user: "app", fingerprint: "c"})
+
+	if status, claimed := list.claim(allowlistKey{user: "app", fingerprint: "c"}, FingerprintPending, 2); !claimed || status != FingerprintPending {
+		t.Errorf("forgotten fingerprint claim = %s, %v", status, claimed)
+	}
+
+	if status, claimed := list.claim(allowlistKey{user: "app", fingerprint: "a"}, FingerprintPending, 2); claimed || status != FingerprintAllowed {
+		t.Errorf("known fingerprint claim = %s, %v, want its status", status, claimed)
+	}
+}
+
+func TestAllowlistLearning(t *testing.T) {
+	now := time.Now()
+
+	if list := (allowlist{}); !list.learning(now) {
+		t.Error("learning without a limit ended")
+	}
+
+	list := allowlist{learnUntil: now.Add(time.Hour)}
+
+	if !list.learning(now) || list.learning(now.Add(2*time.Hour)) {
+		t.Error("learning did not end at learnUntil")
+	}
+}
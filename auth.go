@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+
+	"thesis/store"
+)
+
+// Client authentication methods, chosen with CLIENT_AUTH_METHOD for clients
+// that do not send a token startup parameter
+const (
+	ClientAuthToken = "token"
+	ClientAuthScram = "scram-sha-256"
+	ClientAuthJWT   = "jwt" // the password is a JWT, sent in cleartext over TLS
+)
+
+// maxAuthMessageLength caps messages from clients that have not authenticated
+// yet, the same limit PostgreSQL applies to authentication tokens
+const maxAuthMessageLength = 65535
+
+// Authentication request codes sent in 'R' messages
+const (
+	authOK                = 0
+	authCleartextPassword = 3
+	authMD5Password       = 5
+	authSASL              = 10
+	authSASLContinue      = 11
+	authSASLFinal         = 12
+)
+
+// authenticateClient authenticates the client as a proxy user and returns its
+// name and role. A JWT in the token startup parameter is always accepted; otherwise the
+// configured method runs. Failures have already been reported to the client.
+func (p *Proxy) authenticateClient(request *Request, params map[string]string) (string, UserRole, error) {
+	if token, ok := params[TokenKey]; ok {
+		// the backend must never see the token
+		delete(params, TokenKey)
+
+		username, role, err := p.validateJWT(request.ctx, request.requestID, token)
+		if err != nil {
+			_ = writeError(request.conn, "FATAL", "28000", "token is invalid")
+			return "", "", err
+		}
+
+		return username, role, nil
+	}
+
+	switch p.config.clientAuthMethod {
+	case ClientAuthScram:
+		role, err := p.authenticateScram(request, params["user"])
+		return params["user"], role, err
+	case ClientAuthJWT:
+		return p.authenticateJWTPassword(request)
+	default:
+		_ = writeError(request.conn, "FATAL", "28000", "token is missing")
+		return "", "", fmt.Errorf("token is missing")
+	}
+}
+
+// backfillScramVerifier derives and stores the SCRAM verifier of a user
+// created before proxy users had one, from the password they just proved.
+// The login goes on if it cannot be stored; the next one tries again.
+func (p *Proxy) backfillScramVerifier(ctx context.Context, requestID uuid.UUID, user *store.User, password string) {
+	verifier, err := scramVerifierFor(password)
+	if err == nil {
+		err = p.store.userStore.Update(ctx, requestID, store.User{ID: user.ID, ScramVerifier: verifier, UpdatedAt: time.Now()})
+	}
+
+	if err != nil {
+		p.logger.Error().Err(err).Msgf("Failed to store SCRAM verifier for %s", user.Username)
+		return
+	}
+
+	p.logger.Info().Msgf("Stored SCRAM verifier for %s", user.Username)
+}
+
+// authenticateScram runs a SCRAM-SHA-256 exchange with the client against the
+// verifier stored for the proxy user
+func (p *Proxy) authenticateScram(request *Request, username string) (UserRole, error) {
+	failed := func(err error) (UserRole, error) {
+		_ = writeError(request.conn, "FATAL", "28P01", fmt.Sprintf("password authentication failed for user %q", username))
+		return "", fmt.Errorf("SCRAM authentication failed for %s: %w", username, err)
+	}
+
+	var (
+		role     UserRole
+		verifier *scramVerifier
+		unknown  error
+	)
+
+	user, err := p.store.userStore.GetByUsername(request.ctx, request.requestID, username)
+	switch {
+	case err != nil:
+	case user.DeletedAt != nil:
+		err = fmt.Errorf("user is deleted")
+	case user.ScramVerifier == "":
+		err = fmt.Errorf("user has no SCRAM verifier yet; it is derived on the next HTTP login or password change")
+	default:
+		role = UserRole(user.Role)
+		verifier, err = parseScramVerifier(user.ScramVerifier)
+	}
+
+	if err != nil {
+		// finish the exchange against a random verifier, so that a client
+		// cannot tell unknown users from wrong passwords
+		unknown = err
+
+		if verifier, err = newScramVerifier(request.requestID.String()); err != nil {
+			return failed(err)
+		}
+	}
+
+	server := &scramServer{verifier: verifier}
+
+	mechanisms := []byte(scramMechanism + "\x00\x00")
+	if _, err = request.conn.Write(encodeAuthentication(authSASL, mechanisms)); err != nil {
+		return "", err
+	}
+
+	// SASLInitialResponse: mechanism name, then the length-prefixed client-first-message
+	msg, err := readPasswordMessage(request)
+	if err != nil {
+		return "", err
+	}
+
+	mechanism, rest, ok := bytes.Cut(msg[5:], []byte{0})
+	if !ok || string(mechanism) != scramMechanism || len(rest) < 4 {
+		return failed(fmt.Errorf("unsupported SASL mechanism %q", mechanism))
+	}
+
+	serverFirst, err := server.handleClientFirst(string(rest[4:]))
+	if err != nil {
+		return failed(err)
+	}
+
+	if _, err = request.conn.Write(encodeAuthentication(authSASLContinue, []byte(serverFirst))); err != nil {
+		return "", err
+	}
+
+	// SASLResponse: the client-final-message
+	if msg, err = readPasswordMessage(request); err != nil {
+		return "", err
+	}
+
+	serverFinal, err := server.handleClientFinal(string(msg[5:]))
+	if err != nil {
+		return failed(err)
+	}
+
+	if unknown != nil {
+		return failed(unknown)
+	}
+
+	if _, err = request.conn.Write(encodeAuthentication(authSASLFinal, []byte(serverFinal))); err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+// authenticateJWTPassword asks the client for a cleartext password and
+// validates it as a JWT, such as the one /users/login hands out. The token is
+// a bearer credential, so this is refused on unencrypted connections.
+func (p *Proxy) authenticateJWTPassword(request *Request) (string, UserRole, error) {
+	if _, isTLS := request.conn.(*tls.Conn); !isTLS {
+		_ = writeError(request.conn, "FATAL", "28000", "password authentication with a token requires an SSL connection")
+		return "", "", fmt.Errorf("token password sent over a plaintext connection")
+	}
+
+	if _, err := request.conn.Write(encodeAuthentication(authCleartextPassword, nil)); err != nil {
+		return "", "", err
+	}
+
+	msg, err := readPasswordMessage(request)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := string(bytes.TrimRight(msg[5:], "\x00"))
+
+	username, role, err := p.validateJWT(request.ctx, request.requestID, token)
+	if err != nil {
+		_ = writeError(request.conn, "FATAL", "28P01", "token is invalid")
+		return "", "", err
+	}
+
+	return username, role, nil
+}
+
+// encodeStartupResponse builds what follows a successful authentication:
+// AuthenticationOk, the session's parameters, its cancel key and ReadyForQuery
+func encodeStartupResponse(params map[string]string, key cancelKey) []byte {
+	msg := encodeAuthentication(authOK, nil)
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		body := name + "\x00" + params[name] + "\x00"
+
+		status := []byte{'S', 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(status[1:5], uint32(4+len(body)))
+		msg = append(append(msg, status...), body...)
+	}
+
+	msg = append(msg, encodeBackendKeyData(key)...)
+
+	return append(msg, encodeReadyForQuery('I')...)
+}
+
+// readPasswordMessage reads the client's next message, which must be a
+// PasswordMessage, SASLInitialResponse or SASLResponse ('p')
+func readPasswordMessage(request *Request) ([]byte, error) {
+	msg, err := readMessageLimit(request.conn, maxAuthMessageLength)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg[0] != 'p' {
+		_ = writeError(request.conn, "FATAL", "08P01", fmt.Sprintf("expected password response, got message type %q", msg[0]))
+		return nil, fmt.Errorf("expected password response, got message type %q", msg[0])
+	}
+
+	return msg, nil
+}
+
+// encodeAuthentication builds an authentication request ('R') message
+func encodeAuthentication(code uint32, data []byte) []byte {
+	msg := make([]byte, 9, 9+len(data))
+	msg[0] = 'R'
+	binary.BigEndian.PutUint32(msg[1:5], uint32(8+len(data)))
+	binary.BigEndian.PutUint32(msg[5:9], code)
+
+	return append(msg, data...)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"thesis/store"
+)
+
+// backendError is an ErrorResponse a backend answered the startup with
+type backendError struct {
+	addr string
+	msg  []byte
+}
+
+func (e *backendError) Error() string {
+	return fmt.Sprintf("%s refused the session: %s", e.addr, parseErrorOrNotice(e.msg[5:])["M"])
+}
+
+// authenticateBackend answers the backend's authentication requests after a
+// startup message was sent, using the proxy-held credential, and returns once
+// the backend reports AuthenticationOk. The ParameterStatus, BackendKeyData
+// and ReadyForQuery messages that follow are left unread.
+func authenticateBackend(conn net.Conn, addr string, credential *store.UpstreamCredential) error {
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+
+	var scram *scramClient
+
+	password := func() (string, error) {
+		if credential == nil {
+			return "", fmt.Errorf("%s requires a password but no upstream credential is configured", addr)
+		}
+
+		return credential.DBPassword, nil
+	}
+
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return fmt.Errorf("failed to read authentication request from %s: %w", addr, err)
+		}
+
+		switch msg[0] {
+		case 'E':
+			return &backendError{addr: addr, msg: msg}
+		case 'N':
+			continue
+		case 'R':
+		default:
+			return fmt.Errorf("unexpected message type %q from %s during authentication", msg[0], addr)
+		}
+
+		if len(msg) < 9 {
+			return fmt.Errorf("malformed authentication request from %s", addr)
+		}
+
+		var response []byte
+
+		switch code, data := binary.BigEndian.Uint32(msg[5:9]), msg[9:]; code {
+		case authOK:
+			// once SASL started, only a server that proved its signature is trusted
+			if scram != nil && !scram.verified {
+				return fmt.Errorf("%s reported authentication success without completing SCRAM", addr)
+			}
+
+			return conn.SetReadDeadline(time.Time{})
+		case authCleartextPassword:
+			secret, err := password()
+			if err != nil {
+				return err
+			}
+
+			response = encodePasswordMessage([]byte(secret + "\x00"))
+		case authMD5Password:
+			secret, err := password()
+			if err != nil {
+				return err
+			}
+
+			if len(data) < 4 {
+				return fmt.Errorf("malformed MD5 salt from %s", addr)
+			}
+
+			response = encodePasswordMessage([]byte(md5Password(credential.DBUser, secret, data[:4]) + "\x00"))
+		case authSASL:
+			secret, err := password()
+			if err != nil {
+				return err
+			}
+
+			if !bytes.Contains(data, []byte(scramMechanism+"\x00")) {
+				return fmt.Errorf("%s offers no supported SASL mechanism", addr)
+			}
+
+			if scram, err = newScramClient(secret); err != nil {
+				return err
+			}
+
+			first := scram.clientFirst()
+
+			body := append([]byte(scramMechanism+"\x00"), 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(body[len(body)-4:], uint32(len(first)))
+			response = encodePasswordMessage(append(body, first...))
+		case authSASLContinue:
+			if scram == nil {
+				return fmt.Errorf("unexpected SASL continuation from %s", addr)
+			}
+
+			final, err := scram.handleServerFirst(string(data))
+			if err != nil {
+				return err
+			}
+
+			response = encodePasswordMessage([]byte(final))
+		case authSASLFinal:
+			if scram == nil {
+				return fmt.Errorf("unexpected SASL outcome from %s", addr)
+			}
+
+			if err = scram.verifyServerFinal(string(data)); err != nil {
+				return fmt.Errorf("%s: %w", addr, err)
+			}
+
+			continue
+		default:
+			return fmt.Errorf("%s requested unsupported authentication method %d", addr, code)
+		}
+
+		if _, err = conn.Write(response); err != nil {
+			return fmt.Errorf("failed to send authentication response to %s: %w", addr, err)
+		}
+	}
+}
+
+// md5Password computes the response to an MD5 authentication request:
+// "md5" + md5(md5(password + user) + salt), in hex
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// encodePasswordMessage builds a PasswordMessage, SASLInitialResponse or SASLResponse
+func encodePasswordMessage(data []byte) []byte {
+	msg := make([]byte, 5, 5+len(data))
+	msg[0] = 'p'
+	binary.BigEndian.PutUint32(msg[1:5], uint32(4+len(data)))
+
+	return append(msg, data...)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// cancelKey is the process ID and secret pair of a BackendKeyData message
+type cancelKey struct {
+	processID uint32
+	secret    uint32
+}
+
+func parseCancelKey(data []byte) cancelKey {
+	return cancelKey{
+		processID: binary.BigEndian.Uint32(data[0:4]),
+		secret:    binary.BigEndian.Uint32(data[4:8]),
+	}
+}
+
+// encodeBackendKeyData builds the BackendKeyData message handed to a client
+func encodeBackendKeyData(key cancelKey) []byte {
+	msg := []byte{'K', 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[5:9], key.processID)
+	binary.BigEndian.PutUint32(msg[9:13], key.secret)
+
+	return msg
+}
+
+// encodeCancelRequest builds the CancelRequest packet for a backend key
+func encodeCancelRequest(key cancelKey) []byte {
+	msg := make([]byte, 16)
+	binary.BigEndian.PutUint32(msg[0:4], 16)
+	binary.BigEndian.PutUint32(msg[4:8], cancelRequestCode)
+	binary.BigEndian.PutUint32(msg[8:12], key.processID)
+	binary.BigEndian.PutUint32(msg[12:16], key.secret)
+
+	return msg
+}
+
+// registerSession issues the session the key its client uses to cancel
+// queries. Clients never see the backends' own keys, since the backend
+// behind a session changes as statements are routed.
+func (p *Proxy) registerSession(session *Session) error {
+	buf := make([]byte, 8)
+
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return fmt.Errorf("failed to generate cancel key: %w", err)
+		}
+
+		key := parseCancelKey(buf)
+		if _, taken := p.sessions[key]; taken {
+			continue
+		}
+
+		session.cancelKey = key
+		p.sessions[key] = session
+
+		return nil
+	}
+}
+
+func (p *Proxy) unregisterSession(session *Session) {
+	p.sessionsLock.Lock()
+	defer p.sessionsLock.Unlock()
+
+	delete(p.sessions, session.cancelKey)
+}
+
+// cancelRequest forwards a client's CancelRequest to the backend currently
+// running the session's statements. Unknown keys are ignored, as PostgreSQL does.
+func (p *Proxy) cancelRequest(msg []byte) {
+	if len(msg) != 16 {
+		p.logger.Warn().Msgf("Invalid cancel request length %d", len(msg))
+		return
+	}
+
+	p.sessionsLock.Lock()
+	session, ok := p.sessions[parseCancelKey(msg[8:16])]
+	p.sessionsLock.Unlock()
+
+	if !ok {
+		p.logger.Warn().Msg("Cancel request for an unknown session")
+		return
+	}
+
+	backend, key := session.cancelTarget()
+	if backend == nil {
+		p.logger.Warn().Msgf("[Conn %d] Cancel request before the backend sent its key", session.request.connID)
+		return
+	}
+
+	conn, err := dialUpstream(backend.upstream.Addr, backend.upstream.config.TLSConfig)
+	if err != nil {
+		p.logger.Error().Err(err).Msgf("[Conn %d] Failed to connect to %s to cancel: %v", session.request.connID, backend.upstream.Addr, err)
+		return
+	}
+
+	defer conn.Close()
+
+	if err = conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		p.logger.Error().Err(err).Msgf("[Conn %d] Failed to set deadline: %v", session.request.connID, err)
+		return
+	}
+
+	if _, err = conn.Write(encodeCancelRequest(key)); err != nil {
+		p.logger.Error().Err(err).Msgf("[Conn %d] Failed to send cancel request to %s: %v", session.request.connID, backend.upstream.Addr, err)
+		return
+	}
+
+	p.logger.Info().Msgf("[Conn %d] Forwarded cancel request to %s", session.request.connID, backend.upstream.Addr)
+}
@@ -1,32 +1,177 @@
 package main
 
 import (
+	"cmp"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Config holds proxy configuration
 type Config struct {
-	listenAddr         string
+	listeners          []ListenerConfig
 	pingInterval       int
-	servers            []string
+	primary            UpstreamConfig
+	servers            []UpstreamConfig
+	replicaBalancers   map[string]BalancerConfig // how reads are spread over each replica group, "" for all replicas
 	HTTPListen         string
 	JWTSecret          string
 	adminUser          string
 	adminPassword      string
 	connectionPoolSize int
+	poolMinIdle        int           // idle backend sessions kept open per user and database
+	poolMaxIdleTime    time.Duration // idle backend sessions are closed after this long
+	poolMaxLifetime    time.Duration // backend sessions are closed after this long
+	poolMaxWait        time.Duration // how long a client waits for a backend session when the pool is full
+	poolMaxWaiters     int           // clients that may wait for a backend session at once, 0 for no limit
+
+	// TLS termination for client connections
+	tlsCertFile          string
+	tlsKeyFile           string
+	tlsClientCAFile      string
+	tlsRequireClientCert bool
+	tlsRequired          bool
+
+	clientAuthMethod string // how clients without a token startup parameter authenticate
+
+	// login the health checker measures replication with; empty to only ping
+	healthCheckUser     string
+	healthCheckPassword string
+	healthCheckDatabase string
+	replicaMaxLag       time.Duration // replicas further behind get no reads, 0 for no limit
+
+	consistency          string        // read-your-writes mode of sessions that do not choose one
+	readYourWritesWindow time.Duration // how long reads go to the primary after a write in window mode
+
+	allowlistMode       string        // what the query allowlist does with fingerprints users send
+	allowlistLearnFor   time.Duration // how long learn mode learns after start-up, 0 for no limit
+	allowlistMaxPending int           // fingerprints per user recorded to wait for approval, 0 for no limit
+}
+
+// ListenerConfig is one address clients connect to and how their backend
+// sessions are pooled. LISTEN_ADDRESS entries take the form
+// host:port?pool_mode=transaction&replica_group=reporting; the mode defaults
+// to POOL_MODE, and without a replica group reads go to every replica.
+type ListenerConfig struct {
+	addr         string
+	poolMode     string // session or transaction
+	replicaGroup string // the replicas its clients read from, "" for all of them
+}
+
+// UpstreamConfig is one upstream server and how the proxy connects to it.
+// MASTER and SLAVES entries take the form host:port?sslmode=verify-full&sslrootcert=ca.pem;
+// options left out fall back to the UPSTREAM_SSL* variables. SLAVES entries may
+// also carry a weight, as in host:port?weight=3, for the weighted strategies.
+// Any entry may carry a name, as in host:port?name=reporting, that routing
+// hints refer to it by. SLAVES entries may join a replica group, as in
+// host:port?group=reporting, which listeners send reads to and which has a
+// load-balancing strategy of its own.
+type UpstreamConfig struct {
+	addr        string
+	name        string // what /* goxy:upstream=name */ hints call it; defaults to addr
+	sslMode     string // disable, require, verify-ca or verify-full
+	sslRootCert string // CA bundle the server certificate is verified against
+	sslCert     string // client certificate presented to the server
+	sslKey      string
+	weight      int    // relative share of the reads, from ?weight=; defaults to 1
+	group       string // replica group, from ?group=
+}
+
+// parseUpstreamConfig splits an upstream entry into its address and TLS options
+func parseUpstreamConfig(raw string, defaults UpstreamConfig) UpstreamConfig {
+	upstream := defaults
+
+	addr, query, _ := strings.Cut(strings.TrimSpace(raw), "?")
+	upstream.addr = addr
+	upstream.name = addr
+
+	options, _ := url.ParseQuery(query)
+
+	if v := options.Get("sslmode"); v != "" {
+		upstream.sslMode = v
+	}
+
+	if v := options.Get("sslrootcert"); v != "" {
+		upstream.sslRootCert = v
+	}
+
+	if v := options.Get("sslcert"); v != "" {
+		upstream.sslCert = v
+	}
+
+	if v := options.Get("sslkey"); v != "" {
+		upstream.sslKey = v
+	}
+
+	if v := options.Get("name"); v != "" {
+		upstream.name = v
+	}
+
+	if v := options.Get("group"); v != "" {
+		upstream.group = v
+	}
+
+	if weight, err := strconv.Atoi(options.Get("weight")); err == nil && weight > 0 {
+		upstream.weight = weight
+	}
+
+	return upstream
+}
+
+// parseListenerConfig splits a listener entry into its address, pool mode and
+// replica group
+func parseListenerConfig(raw string, defaultMode string) ListenerConfig {
+	addr, query, _ := strings.Cut(strings.TrimSpace(raw), "?")
+	listener := ListenerConfig{addr: addr, poolMode: defaultMode}
+
+	options, _ := url.ParseQuery(query)
+
+	if v := options.Get("pool_mode"); v != "" {
+		listener.poolMode = v
+	}
+
+	listener.replicaGroup = options.Get("replica_group")
+
+	return listener
 }
 
 func NewConfig() *Config {
+	master := os.Getenv("MASTER")
 	slavesStr := os.Getenv("SLAVES")
 	listenAddr := os.Getenv("LISTEN_ADDRESS")
+	poolMode := os.Getenv("POOL_MODE")
 	pingInterval := os.Getenv("PING_INTERVAL")
 	httpListen := os.Getenv("HTTP_LISTENER")
 	jwtSecret := os.Getenv("JWT_SECRET")
 	adminUser := os.Getenv("ADMIN_USER")
 	adminPassword := os.Getenv("ADMIN_PASSWORD")
 	connectionPoolSize := os.Getenv("CONNECTION_POOL_SIZE")
+	poolMinIdle, _ := strconv.Atoi(os.Getenv("POOL_MIN_IDLE"))
+	poolMaxWaiters, _ := strconv.Atoi(os.Getenv("POOL_MAX_WAITERS"))
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("TLS_KEY_FILE")
+	tlsClientCAFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	tlsRequireClientCert, _ := strconv.ParseBool(os.Getenv("TLS_REQUIRE_CLIENT_CERT"))
+	tlsRequired, _ := strconv.ParseBool(os.Getenv("TLS_REQUIRED"))
+
+	clientAuthMethod := os.Getenv("CLIENT_AUTH_METHOD")
+	if clientAuthMethod == "" {
+		clientAuthMethod = ClientAuthScram
+	}
+
+	upstreamDefaults := UpstreamConfig{
+		weight:      1,
+		sslMode:     os.Getenv("UPSTREAM_SSLMODE"),
+		sslRootCert: os.Getenv("UPSTREAM_SSLROOTCERT"),
+		sslCert:     os.Getenv("UPSTREAM_SSLCERT"),
+		sslKey:      os.Getenv("UPSTREAM_SSLKEY"),
+	}
+
+	if poolMode == "" {
+		poolMode = PoolModeSession
+	}
 
 	pingIntInterval, _ := strconv.Atoi(pingInterval)
 
@@ -35,16 +180,107 @@ func NewConfig() *Config {
 		connectionPoolSizeInt = 10
 	}
 
-	slaves := strings.Split(slavesStr, ",")
+	poolMaxIdleTime, err := time.ParseDuration(os.Getenv("POOL_MAX_IDLE_TIME"))
+	if err != nil {
+		poolMaxIdleTime = 30 * time.Second
+	}
+
+	poolMaxLifetime, err := time.ParseDuration(os.Getenv("POOL_MAX_LIFETIME"))
+	if err != nil {
+		poolMaxLifetime = time.Hour
+	}
+
+	replicaMaxLag, _ := time.ParseDuration(os.Getenv("REPLICA_MAX_LAG"))
+
+	consistency := os.Getenv("CONSISTENCY")
+	if consistency == "" {
+		consistency = ConsistencyEventual
+	}
+
+	readYourWritesWindow, err := time.ParseDuration(os.Getenv("READ_YOUR_WRITES_WINDOW"))
+	if err != nil {
+		readYourWritesWindow = 5 * time.Second
+	}
+
+	allowlistMode := os.Getenv("ALLOWLIST_MODE")
+	if allowlistMode == "" {
+		allowlistMode = AllowlistOff
+	}
+
+	allowlistLearnFor, _ := time.ParseDuration(os.Getenv("ALLOWLIST_LEARN_FOR"))
+
+	allowlistMaxPending, err := strconv.Atoi(os.Getenv("ALLOWLIST_MAX_PENDING"))
+	if err != nil {
+		allowlistMaxPending = 1000
+	}
+
+	healthCheckDatabase := os.Getenv("HEALTH_CHECK_DATABASE")
+	if healthCheckDatabase == "" {
+		healthCheckDatabase = os.Getenv("HEALTH_CHECK_USER")
+	}
+
+	poolMaxWait, err := time.ParseDuration(os.Getenv("POOL_MAX_WAIT"))
+	if err != nil {
+		poolMaxWait = 30 * time.Second
+	}
+
+	slaves := make([]UpstreamConfig, 0)
+	for _, v := range strings.Split(slavesStr, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			slaves = append(slaves, parseUpstreamConfig(v, upstreamDefaults))
+		}
+	}
+
+	// a group without a REPLICA_BALANCER_<GROUP> of its own uses REPLICA_BALANCER
+	replicaBalancers := map[string]BalancerConfig{"": parseBalancerConfig(os.Getenv("REPLICA_BALANCER"))}
+	for _, slave := range slaves {
+		if _, ok := replicaBalancers[slave.group]; !ok {
+			replicaBalancers[slave.group] = parseBalancerConfig(cmp.Or(os.Getenv(balancerVariable(slave.group)), os.Getenv("REPLICA_BALANCER")))
+		}
+	}
+
+	listeners := make([]ListenerConfig, 0)
+	for _, v := range strings.Split(listenAddr, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			listeners = append(listeners, parseListenerConfig(v, poolMode))
+		}
+	}
 
 	return &Config{
+		primary:            parseUpstreamConfig(master, upstreamDefaults),
 		servers:            slaves,
-		listenAddr:         listenAddr,
+		replicaBalancers:   replicaBalancers,
+		listeners:          listeners,
 		pingInterval:       pingIntInterval,
 		HTTPListen:         httpListen,
 		JWTSecret:          jwtSecret,
 		adminUser:          adminUser,
 		adminPassword:      adminPassword,
 		connectionPoolSize: connectionPoolSizeInt,
+		poolMinIdle:        poolMinIdle,
+		poolMaxIdleTime:    poolMaxIdleTime,
+		poolMaxLifetime:    poolMaxLifetime,
+		poolMaxWait:        poolMaxWait,
+		poolMaxWaiters:     poolMaxWaiters,
+
+		tlsCertFile:          tlsCertFile,
+		tlsKeyFile:           tlsKeyFile,
+		tlsClientCAFile:      tlsClientCAFile,
+		tlsRequireClientCert: tlsRequireClientCert,
+		tlsRequired:          tlsRequired,
+
+		clientAuthMethod: clientAuthMethod,
+
+		healthCheckUser:     os.Getenv("HEALTH_CHECK_USER"),
+		healthCheckPassword: os.Getenv("HEALTH_CHECK_PASSWORD"),
+		healthCheckDatabase: healthCheckDatabase,
+		replicaMaxLag:       replicaMaxLag,
+
+		consistency:          consistency,
+		readYourWritesWindow: readYourWritesWindow,
+
+		allowlistMode:       allowlistMode,
+		allowlistLearnFor:   allowlistLearnFor,
+		allowlistMaxPending: allowlistMaxPending,
 	}
 }
@@ -1,21 +1,22 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"maps"
 	"net"
-	"sync"
+	"sync/atomic"
 )
 
 // defer closing client connection
-// peek the type of request it is [SELECT, ...]
-// select an appropriate backend server
-// lock to prevent concurrent access to the same backend
-// get the locked connection instance
-// defers unlocking the connection
-// perform other actions with the postgres connection
+// authenticate the client against the primary
+// route each statement to the primary or a replica [SELECT, ...]
+// defers releasing the backend connections
+// perform other actions with the postgres connections
 func (p *Proxy) handleConnection(request *Request) {
 	// defer closing client connection
 	defer func(clientConn net.Conn) {
-		if err := clientConn.Close(); err != nil {
+		if err := clientConn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			p.logger.Warn().Err(err).Msgf("Failed to close client connection: %v", err)
 		}
 	}(request.conn)
@@ -33,75 +34,164 @@ func (p *Proxy) handleConnection(request *Request) {
 		}()
 	}()
 
-	// read a startup message
-	rawMessage, _ := readStartupMessage(request.conn)
+	// read a startup message, negotiating TLS first if the client asks for it
+	rawMessage, err := p.readStartup(request)
+	if err != nil {
+		p.logger.Warn().Err(err).Msgf("Failed to read startup message: %v", err)
+		return
+	}
 
 	//parse the startup message
 	params, protocol := parseTheStartupMessage(rawMessage)
 
-	if _, ok := params[TokenKey]; !ok {
-		_ = writeError(request.conn, "28000", "FATAL", "token is missing")
+	if protocol == cancelRequestCode {
+		p.cancelRequest(rawMessage)
 		return
 	}
 
-	token, _ := params[TokenKey]
+	// authenticate the client as a proxy user
+	username, role, err := p.authenticateClient(request, params)
+	if err != nil {
+		p.logger.Warn().Err(err).Msgf("[Conn %d] Client authentication failed: %v", request.connID, err)
+		return
+	}
 
-	// validate the token
-	_, role, err := p.validateJWT(request.ctx, request.requestID, token)
+	// log in to the backends with the proxy-held credential of the user or role
+	credential, err := p.store.credentialStore.GetFor(request.ctx, request.requestID, username, string(role))
 	if err != nil {
-		_ = writeError(request.conn, "28000", "FATAL", "token is invalid")
+		_ = writeError(request.conn, "FATAL", "XX000", "cannot look up upstream credentials")
 		return
 	}
 
-	// delete/modify token from params
-	delete(params, "token")
+	// backend sessions are pooled per database user and database. Without a
+	// credential the backend is logged in to as the authenticated proxy user,
+	// never as whatever user the client put in its startup message.
+	poolKey := PoolKey{User: username, Database: params["database"]}
+	if credential != nil {
+		poolKey.User = credential.DBUser
+	}
 
-	//build a startup message
-	newMessage := buildStartupMessage(params, protocol)
+	if poolKey.Database == "" {
+		poolKey.Database = poolKey.User
+	}
 
-	if len(p.servers) == 0 {
-		_ = writeError(request.conn, "08006", "FATAL", "all servers are down, please try again later")
-		return
+	// the client may ask to read its own writes; the backend never sees this
+	consistency := p.config.consistency
+	if mode, ok := params[ConsistencyKey]; ok {
+		delete(params, ConsistencyKey)
+
+		if !validConsistency(mode) {
+			_ = writeError(request.conn, "FATAL", "22023", fmt.Sprintf("invalid value for parameter %q: %q", ConsistencyKey, mode))
+			return
+		}
+
+		consistency = mode
 	}
 
-	// Connect to the selected PostgresSQL backend
-	upstream := p.getNextServer()
-	if upstream == nil {
-		_ = writeError(request.conn, "08004", "FATAL", "no available upstream servers")
+	settings := startupSettings(params)
+
+	// Writes, and everything until a replica is opened, go to the primary
+	upstream := p.primary
+	pool := upstream.pool.Load()
+	if !upstream.Healthy || pool == nil {
+		_ = writeError(request.conn, "FATAL", "08006", "the primary server is down, please try again later")
 		return
 	}
 
-	// get a connection from the pool
-	conn, err := upstream.pool.Get(request.ctx)
+	// get an authenticated session from the pool; the client only ever
+	// authenticates to the proxy
+	server, err := pool.Get(request.ctx, poolKey, credential)
 	if err != nil {
-		_ = writeError(request.conn, "08001", "ERROR", "cannot get backend connection")
+		p.logger.Error().Err(err).Msgf("[Conn %d] Cannot get backend session: %v", request.connID, err)
+
+		var (
+			refused   *backendError
+			exhausted *poolExhaustedError
+		)
+
+		switch {
+		case errors.As(err, &refused):
+			_, _ = request.conn.Write(refused.msg)
+		case errors.As(err, &exhausted):
+			_ = writeError(request.conn, "FATAL", "53300", exhausted.Error())
+		default:
+			_ = writeError(request.conn, "FATAL", "08001", "cannot get backend connection")
+		}
+
 		return
 	}
 
-	// defer releasing the connection to the pool
-	defer upstream.pool.Release(conn)
-
 	// set the server address in the request
 	request.serverAddr = &upstream.Addr
 
-	// Send a startup message to PostgresSQL
-	_, err = conn.Write(newMessage)
-	if err != nil {
-		_ = writeError(request.conn, "", "", "something went wrong2")
+	if err = server.setParams(settings); err != nil {
+		pool.releaseFailed(server, err)
+		p.logger.Warn().Err(err).Msgf("[Conn %d] Invalid startup parameters: %v", request.connID, err)
+
+		var refused *backendError
+		if errors.As(err, &refused) {
+			_ = writeError(request.conn, "FATAL", parseErrorOrNotice(refused.msg[5:])["C"], parseErrorOrNotice(refused.msg[5:])["M"])
+		} else {
+			_ = writeError(request.conn, "FATAL", "08006", "cannot apply startup parameters")
+		}
+
+		return
+	}
+
+	serverParams := maps.Clone(server.params)
+
+	// in transaction pooling the client borrows a backend per transaction;
+	// this one only vouched for its login and startup parameters
+	primary := newBackendConn(upstream, pool, server)
+	if request.poolMode == PoolModeTransaction {
+		pool.Release(server)
+		primary = nil
+	}
+
+	session := NewSession(request, role, poolKey, settings, credential, primary)
+	session.username = username
+	session.queryStats = &p.queryStats
+	session.consistency = consistency
+
+	// from here on the session carries the client's settings
+	if err = p.registerSession(session); err != nil {
+		if primary != nil {
+			pool.Discard(server)
+		}
+
+		_ = writeError(request.conn, "FATAL", "XX000", "cannot issue a cancel key")
 		return
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	// answer the startup as the backend would have
+	if _, err = request.conn.Write(encodeStartupResponse(serverParams, session.cancelKey)); err != nil {
+		p.unregisterSession(session)
+
+		if primary != nil {
+			pool.Discard(server)
+		}
+
+		return
+	}
+
+	defer p.unregisterSession(session)
 
 	// Client -> PROXY
-	go p.frontend(conn, request, int(request.connID), role, &wg)
+	session.wg.Add(1)
+	go p.frontend(session)
+
+	// PROXY -> Client; the backend goroutines hand their connections back
+	// to the pools when they finish
+	if primary != nil {
+		p.startBackend(session, primary)
+	}
 
-	// PROXY -> Client
-	go p.backend(conn, request.conn, int(request.connID), &wg)
+	// wait for the frontend and every backend goroutine to finish
+	session.wg.Wait()
 
-	// wait for both goroutines to finish
-	wg.Wait()
+	if request.poolMode != session.poolMode {
+		atomic.AddInt64(&p.stats.pinnedSessions, -1)
+	}
 
 	p.logger.Info().Msgf("[Conn %d] Connection closed", request.connID)
 }
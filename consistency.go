@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Read-your-writes modes of a session, chosen with CONSISTENCY, the
+// goxy.consistency startup parameter or a /* goxy:consistency=... */ hint
+const (
+	ConsistencyEventual = "eventual" // reads go to replicas whatever they have replayed
+	ConsistencyWindow   = "window"   // reads go to the primary for READ_YOUR_WRITES_WINDOW after a write
+	ConsistencyLSN      = "lsn"      // reads go to replicas that replayed the session's last write
+)
+
+func validConsistency(mode string) bool {
+	return mode == ConsistencyEventual || mode == ConsistencyWindow || mode == ConsistencyLSN
+}
+
+// noteWrite records that the session sent a write
+func (s *Session) noteWrite() {
+	s.lastWrite = time.Now()
+	s.lsnPending = true
+}
+
+// applyHints switches the session to the consistency mode a query's hint asks
+// for, and warns about routing hints that cannot be followed
+func (p *Proxy) applyHints(session *Session, query string) {
+	hints, _ := parseHints(query)
+
+	if route, ok := hints[HintRoute]; ok && !strings.EqualFold(route, RoutePrimary) && !strings.EqualFold(route, RouteReplica) {
+		p.logger.Warn().Msgf("[Conn %d] Ignoring unknown route hint %q", session.request.connID, route)
+	}
+
+	if name, ok := hints[HintUpstream]; ok && p.upstreamByName(name) == nil {
+		p.logger.Warn().Msgf("[Conn %d] Ignoring hint for unknown, unhealthy or lagging upstream %q", session.request.connID, name)
+	}
+
+	mode, ok := hints[HintConsistency]
+	if !ok {
+		return
+	}
+
+	if !validConsistency(mode) {
+		p.logger.Warn().Msgf("[Conn %d] Ignoring unknown consistency hint %q", session.request.connID, mode)
+		return
+	}
+
+	session.consistency = mode
+}
+
+// readsFromPrimary reports whether a read has to go to the primary for the
+// session to see its own writes
+func (p *Proxy) readsFromPrimary(session *Session) bool {
+	switch session.consistency {
+	case ConsistencyWindow:
+		return time.Since(session.lastWrite) < p.config.readYourWritesWindow
+	case ConsistencyLSN:
+		lsn, ok := p.sessionWriteLSN(session)
+		if !ok {
+			return true
+		}
+
+		if lsn == 0 {
+			return false
+		}
+
+		// a hint names the replica the read goes to
+		if session.upstreamHint != nil {
+			return !p.replicaCaughtUp(session, session.upstreamHint, lsn)
+		}
+
+		// the read stays on the replica the session already reads from, if any
+		if replica := session.readReplica(); replica != nil {
+			return !p.replicaCaughtUp(session, replica.upstream, lsn)
+		}
+
+		return len(p.readableReplicas(session)) == 0
+	}
+
+	return false
+}
+
+// sessionWriteLSN returns the primary's WAL position after the session's
+// last write, looking it up once the write has finished. It returns 0 when
+// the session has not written, and false when the position is unknown.
+func (p *Proxy) sessionWriteLSN(session *Session) (uint64, bool) {
+	if !session.lsnPending {
+		return session.writeLSN, true
+	}
+
+	// the write must have finished, and committed, before its position counts
+	session.waitIdle()
+
+	session.lock.Lock()
+	txStatus := session.txStatus
+	session.lock.Unlock()
+
+	if txStatus != 'I' {
+		return 0, false
+	}
+
+	lsn, err := p.queryLSN(session, p.primary, "SELECT pg_current_wal_lsn()")
+	if err != nil {
+		p.logger.Warn().Err(err).Msgf("[Conn %d] Cannot look up the WAL position; reading from the primary: %v", session.request.connID, err)
+		return 0, false
+	}
+
+	session.writeLSN, session.lsnPending = lsn, false
+
+	return lsn, true
+}
+
+// replicaCaughtUp reports whether upstream has replayed the WAL up to lsn,
+// asking it again when its last known position is behind
+func (p *Proxy) replicaCaughtUp(session *Session, upstream *Upstream, lsn uint64) bool {
+	upstream.lock.Lock()
+	replayed := upstream.replayLSN
+	upstream.lock.Unlock()
+
+	if replayed >= lsn {
+		return true
+	}
+
+	replayed, err := p.queryLSN(session, upstream, "SELECT pg_last_wal_replay_lsn()")
+	if err != nil {
+		p.logger.Warn().Err(err).Msgf("[Conn %d] Cannot look up the replay position of %s: %v", session.request.connID, upstream.Addr, err)
+		return false
+	}
+
+	upstream.lock.Lock()
+	upstream.replayLSN = max(upstream.replayLSN, replayed)
+	upstream.lock.Unlock()
+
+	return replayed >= lsn
+}
+
+// queryLSN runs a query returning a WAL position on upstream. When the
+// position cannot be looked up in time, the read goes to the primary.
+func (p *Proxy) queryLSN(session *Session, upstream *Upstream, query string) (uint64, error) {
+	row, err := p.queryUpstream(session, upstream, query)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(row) != 1 {
+		return 0, fmt.Errorf("unexpected reply to %q from %s", query, upstream.Addr)
+	}
+
+	return parseLSN(row[0])
+}
+
+// parseLSN parses a WAL position in its text form, such as 16/B374D848
+func parseLSN(value string) (uint64, error) {
+	high, low, ok := strings.Cut(value, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid WAL position %q", value)
+	}
+
+	hi, err := strconv.ParseUint(high, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL position %q", value)
+	}
+
+	lo, err := strconv.ParseUint(low, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WAL position %q", value)
+	}
+
+	return hi<<32 | lo, nil
+}
@@ -10,6 +10,19 @@ const (
 
 type UpstreamRole int
 
+const (
+	UpstreamPrimary UpstreamRole = iota
+	UpstreamReplica
+)
+
+func (r UpstreamRole) String() string {
+	if r == UpstreamPrimary {
+		return "primary"
+	}
+
+	return "replica"
+}
+
 // UserRole defines user roles for RBAC
 type UserRole string
 
@@ -20,3 +33,6 @@ const (
 )
 
 const TokenKey = "token"
+
+// ConsistencyKey is the startup parameter a client chooses its read-your-writes mode with
+const ConsistencyKey = "goxy.consistency"
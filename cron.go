@@ -5,16 +5,24 @@ import (
 	"errors"
 	"io"
 	"log"
-	"net"
 	"time"
 
 	"github.com/google/uuid"
+
+	"thesis/store"
 )
 
 // health check for primary and replicas
 // spawn goroutines for primary
 // spawn goroutines for each replicas
 func (p *Proxy) healthCheck() {
+	// for the primary
+	go func(primary *Upstream) {
+		if err := p.pingUpstream(primary); err != nil {
+			return
+		}
+	}(p.primary)
+
 	// for healthy servers
 	for _, v := range p.servers {
 		go func(replica *Upstream) {
@@ -43,6 +51,10 @@ func (p *Proxy) pingUpstream(upstream *Upstream) error {
 	ticker := time.NewTicker(p.pingInterval)
 	defer ticker.Stop()
 
+	// the login replication is measured with
+	monitorKey := PoolKey{User: p.config.healthCheckUser, Database: p.config.healthCheckDatabase}
+	monitorCredential := &store.UpstreamCredential{DBUser: p.config.healthCheckUser, DBPassword: p.config.healthCheckPassword}
+
 	for {
 		select {
 		case <-p.ctx.Done():
@@ -52,7 +64,6 @@ func (p *Proxy) pingUpstream(upstream *Upstream) error {
 			// store previous health state
 			prevHealthy := upstream.Healthy
 
-			upstream.lock.Lock()
 			healthy, lag, start := false, 0, time.Now()
 
 			// Send a ping request
@@ -66,13 +77,34 @@ func (p *Proxy) pingUpstream(upstream *Upstream) error {
 				healthy = true
 			}
 
+			// measure replication, when the health checker has a login
+			var (
+				replication                *replicationStatus
+				replicationLag, inRecovery any // NULL when not measured
+			)
+
+			if healthy && monitorKey.User != "" {
+				if status, err := checkReplication(upstream, monitorKey, monitorCredential); err != nil {
+					p.logger.Warn().Err(err).Msgf("Cannot read the replication status of %s", upstream.Addr)
+				} else {
+					replication = &status
+					replicationLag, inRecovery = status.lag.Milliseconds(), boolToInt(status.inRecovery)
+
+					if status.inRecovery != (upstream.Role == UpstreamReplica) {
+						p.logger.Warn().Msgf("%s is configured as a %s but in_recovery=%v", upstream.Addr, upstream.Role, status.inRecovery)
+					}
+				}
+			}
+
 			// insert database
 			_, err := p.sqliteDB.Exec(
-				`INSERT INTO health_checks(id, healthy, lag, addr, state_change, created_at)
-				 VALUES (?, ?, ?, ?, ?, ?)`,
+				`INSERT INTO health_checks(id, healthy, lag, replication_lag, in_recovery, addr, state_change, created_at)
+				 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
 				uuid.New(),
 				boolToInt(healthy), // store as 1/0
 				lag,
+				replicationLag,
+				inRecovery,
 				upstream.Addr,
 				boolToInt(prevHealthy != healthy), // state change = true if changed
 				time.Now(),
@@ -90,60 +122,119 @@ func (p *Proxy) pingUpstream(upstream *Upstream) error {
 			}
 
 			// update upstream state
+			upstream.lock.Lock()
 			upstream.Healthy = healthy
 			upstream.Lag = lag
+
+			// a replica too far behind gets no new reads until it catches up
+			wasLagging := upstream.lagging
+			if replication != nil {
+				upstream.ReplicationLag = replication.lag
+				upstream.lagging = upstream.Role == UpstreamReplica && p.config.replicaMaxLag > 0 &&
+					replication.lag > p.config.replicaMaxLag
+			}
+
+			lagging := upstream.lagging
 			upstream.lock.Unlock()
 
+			if lagging != wasLagging {
+				if lagging {
+					p.logger.Warn().Msgf("Replica %s lags %s behind the primary; reads avoid it", upstream.Addr, replication.lag)
+				} else {
+					p.logger.Info().Msgf("Replica %s caught up; reads use it again", upstream.Addr)
+				}
+			}
+
 			// HEALTH STATUS HAS CHANGED
 			if prevHealthy != healthy {
 				p.lock.Lock()
 
-				if healthy {
-					// move from unhealthy → healthy
-					for i, v := range p.unhealthy {
-						if v.ID == upstream.ID {
-							p.unhealthy = append(p.unhealthy[:i], p.unhealthy[i+1:]...)
-							break
-						}
-					}
+				// the pool outlives an outage, as sessions may still borrow
+				// from it; only an upstream that never answered lacks one
+				pool := upstream.pool.Load()
 
-					// dangerous: create a new connection pool for each server
-					upstream.pool, _ = NewConnectionPool(upstream.config)
-					p.servers = append(p.servers, upstream)
-				} else {
-					// move from healthy → unhealthy
-					for i, v := range p.servers {
-						if v.ID == upstream.ID {
-							p.servers = append(p.servers[:i], p.servers[i+1:]...)
-							break
-						}
+				switch {
+				case healthy && pool == nil:
+					if pool, err := NewConnectionPool(upstream.config); err == nil {
+						upstream.pool.Store(pool)
+					} else {
+						p.logger.Error().Err(err).Msgf("Failed to create pool for upstream %v", upstream.Addr)
 					}
+				case !healthy && pool != nil:
+					// the idle sessions died with the upstream; the ones in
+					// use fail and are discarded by their sessions
+					pool.DiscardIdle()
+				}
 
-					// close all connections to this server
-					if upstream.pool != nil {
-						upstream.pool.Close()
-					}
+				// only replicas move between the healthy and unhealthy sets
+				if upstream.Role == UpstreamReplica {
+					p.moveReplica(upstream, healthy)
+				}
 
-					// set pool to nil
-					upstream.pool = nil
+				p.lock.Unlock()
+			}
+		}
+	}
+}
 
-					p.unhealthy = append(p.unhealthy, upstream)
+// reapPools closes the expired sessions of every upstream's pool and tops the
+// pools up to their minimum of idle sessions, until the proxy shuts down
+func (p *Proxy) reapPools() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+
+		case <-ticker.C:
+			p.lock.Lock()
+
+			pools := make([]*ConnectionPool, 0, 1+len(p.servers))
+			for _, upstream := range append([]*Upstream{p.primary}, p.servers...) {
+				if pool := upstream.pool.Load(); pool != nil {
+					pools = append(pools, pool)
 				}
+			}
 
-				p.lock.Unlock()
+			p.lock.Unlock()
+
+			for _, pool := range pools {
+				pool.Reap()
 			}
 		}
 	}
 }
 
+// moveReplica moves a replica between p.servers and p.unhealthy after its
+// health changed. The caller must hold p.lock.
+func (p *Proxy) moveReplica(upstream *Upstream, healthy bool) {
+	from, to := &p.servers, &p.unhealthy
+	if healthy {
+		from, to = &p.unhealthy, &p.servers
+	}
+
+	for i, v := range *from {
+		if v.ID == upstream.ID {
+			*from = append((*from)[:i], (*from)[i+1:]...)
+			break
+		}
+	}
+
+	*to = append(*to, upstream)
+}
+
 // Send a simple ping query
 func checkUpstream(up *Upstream) error {
-	conn, err := net.Dial("tcp", up.Addr)
+	conn, err := dialUpstream(up.Addr, up.config.TLSConfig)
 	if err != nil {
 		log.Printf("Failed to connect to %s: %v", up.Addr, err)
 		return err
 	}
 
+	defer conn.Close()
+
 	_, err = conn.Write(encodeSimpleQuery("SELECT 1"))
 	if err != nil {
 		log.Printf("Health check failed: write error to %s: %v", up.Addr, err)
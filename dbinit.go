@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -22,6 +23,24 @@ func dbInit(db *sql.DB, logger zerolog.Logger, config *Config) error {
 		logger.Fatal().Err(err).Msg("Failed to create users table")
 	}
 
+	// Create an upstream credentials table
+	_, err = db.Exec(createUpstreamCredentialTable)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create upstream credentials table")
+	}
+
+	// Create a firewall rules table
+	_, err = db.Exec(createFirewallRuleTable)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create firewall rules table")
+	}
+
+	// Create a query allowlist table
+	_, err = db.Exec(createAllowlistTable)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create allowlist table")
+	}
+
 	// Create a log entry table
 	_, err = db.Exec(createLogEntryTable)
 	if err != nil {
@@ -39,19 +58,59 @@ func dbInit(db *sql.DB, logger zerolog.Logger, config *Config) error {
 		logger.Fatal().Err(err).Msg("Failed to create SQL table")
 	}
 
+	// Add columns introduced after the tables were first created
+	if err = addColumn(db, "sqls", "rejected", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to add rejected column to SQL table")
+	}
+
+	if err = addColumn(db, "sqls", "hint", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to add hint column to SQL table")
+	}
+
+	if err = addColumn(db, "sqls", "type", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to add type column to SQL table")
+	}
+
+	if err = addColumn(db, "sqls", "tables", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to add tables column to SQL table")
+	}
+
+	if err = addColumn(db, "sqls", "rule_id", "TEXT"); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to add rule_id column to SQL table")
+	}
+
+	if err = addColumn(db, "users", "scram_verifier", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to add scram_verifier column to users table")
+	}
+
+	if err = addColumn(db, "health_checks", "replication_lag", "INTEGER"); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to add replication_lag column to health check table")
+	}
+
+	if err = addColumn(db, "health_checks", "in_recovery", "INTEGER"); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to add in_recovery column to health check table")
+	}
+
 	// Insert sample users
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(config.adminPassword), bcrypt.DefaultCost)
 
+	scramVerifier, err := scramVerifierFor(config.adminPassword)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to derive admin SCRAM verifier")
+		return err
+	}
+
 	userID := uuid.New().String()
 	now := time.Now()
 
 	if _, err = db.Exec(
 		`INSERT OR REPLACE INTO users 
-	(id, username, password, is_admin, role, created_at, updated_at, deleted_at) 
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	(id, username, password, scram_verifier, is_admin, role, created_at, updated_at, deleted_at) 
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		userID,
 		config.adminUser,
 		hashedPassword,
+		scramVerifier,
 		1, // is_admin = true
 		UserRoleAdmin,
 		now, // created_at
@@ -64,3 +123,37 @@ func dbInit(db *sql.DB, logger zerolog.Logger, config *Config) error {
 
 	return nil
 }
+
+// addColumn adds a column to an existing table unless it is already there
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+
+		if name == column {
+			return nil
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+
+	return err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"thesis/sqlparser"
+	"thesis/store"
+)
+
+// windowLayout is how a maintenance window gives its start and end, in UTC
+const windowLayout = "15:04"
+
+// firewall holds the rules every statement is checked against before the
+// frontend forwards it, as loaded from the store at start-up and after each
+// change made over the HTTP API
+type firewall struct {
+	lock  sync.RWMutex
+	rules []store.FirewallRule
+}
+
+// loadFirewallRules replaces the rules in force with the ones in the store
+func (p *Proxy) loadFirewallRules(ctx context.Context, requestID uuid.UUID) error {
+	rules, err := p.store.firewallStore.GetAll(ctx, requestID)
+	if err != nil {
+		return err
+	}
+
+	p.firewall.lock.Lock()
+	p.firewall.rules = rules
+	p.firewall.lock.Unlock()
+
+	return nil
+}
+
+// firewallQuery checks every statement of query against the firewall rules
+// in force for the session's user and role. When one is blocked it notes the
+// rule on sql and returns the ErrorResponse to send the client; the query
+// string is refused as a whole, as authorizeQuery does.
+func (p *Proxy) firewallQuery(session *Session, sql *SQL, query string) []byte {
+	p.firewall.lock.RLock()
+	rules := p.firewall.rules
+	p.firewall.lock.RUnlock()
+
+	if len(rules) == 0 || len(query) == 0 {
+		return nil
+	}
+
+	statements, refused := parseQuery(query)
+	if refused != nil {
+		return refused
+	}
+
+	rule, index := blockingRule(rules, session.username, session.role, statements, time.Now())
+	if rule == nil {
+		return nil
+	}
+
+	sql.RuleID, sql.blocked = &rule.ID, index
+
+	p.logger.Warn().Msgf("FROM-CLIENT; [Conn %d] Firewall rule %s (%v) blocked a statement of %s", session.request.connID, rule.Name, rule.ID, session.username)
+
+	return encodeError("ERROR", "42501", fmt.Sprintf("statement blocked by firewall rule %q", rule.Name))
+}
+
+// blockingRule returns the first of rules that blocks one of statements for
+// username and role at now, with the index of that statement, or nil when
+// none does
+func blockingRule(rules []store.FirewallRule, username string, role UserRole, statements []sqlparser.Statement, now time.Time) (*store.FirewallRule, int) {
+	for i, statement := range statements {
+		for _, rule := range rules {
+			if ruleApplies(rule, username, role, now) && ruleMatches(rule, statement) {
+				return &rule, i
+			}
+		}
+	}
+
+	return nil, 0
+}
+
+// ruleApplies reports whether rule is scoped to the user or role and is not
+// lifted by its maintenance window at now
+func ruleApplies(rule store.FirewallRule, username string, role UserRole, now time.Time) bool {
+	if rule.ProxyUser != "" && rule.ProxyUser != username {
+		return false
+	}
+
+	if rule.ProxyRole != "" && UserRole(rule.ProxyRole) != role {
+		return false
+	}
+
+	return !inWindow(rule.WindowStart, rule.WindowEnd, now)
+}
+
+// ruleMatches reports whether statement meets every condition rule sets
+func ruleMatches(rule store.FirewallRule, statement sqlparser.Statement) bool {
+	if types := listOf(rule.StatementTypes); len(types) > 0 && !matchesType(types, statement.Type) {
+		return false
+	}
+
+	if schemas := listOf(rule.Schemas); len(schemas) > 0 && !namesSchema(schemas, statement.Schemas) {
+		return false
+	}
+
+	if rule.MissingWhere && !statement.Unfiltered {
+		return false
+	}
+
+	if rule.CopyProgram && !statement.CopyProgram {
+		return false
+	}
+
+	return true
+}
+
+// matchesType reports whether the statement type is one of types, or a
+// kind of one, as DROP TABLE is a kind of DROP
+func matchesType(types []string, statementType string) bool {
+	for _, t := range types {
+		if strings.EqualFold(statementType, t) || strings.HasPrefix(strings.ToUpper(statementType), strings.ToUpper(t)+" ") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// namesSchema reports whether the statement names one of schemas. Only
+// schemas it names are known; an unqualified table resolves through the
+// search_path on the backend.
+func namesSchema(schemas, named []string) bool {
+	for _, schema := range schemas {
+		for _, name := range named {
+			if strings.EqualFold(schema, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// inWindow reports whether now falls in the daily window from start to end,
+// which may wrap past midnight. A rule without a window is never in it.
+func inWindow(start, end string, now time.Time) bool {
+	from, err := time.Parse(windowLayout, start)
+	if err != nil {
+		return false
+	}
+
+	until, err := time.Parse(windowLayout, end)
+	if err != nil {
+		return false
+	}
+
+	now = now.UTC()
+
+	minute := now.Hour()*60 + now.Minute()
+	first, last := from.Hour()*60+from.Minute(), until.Hour()*60+until.Minute()
+
+	if first <= last {
+		return minute >= first && minute < last
+	}
+
+	return minute >= first || minute < last
+}
+
+// validateFirewallRule checks a rule before it is stored, normalizing its
+// lists of statement types and schemas
+func validateFirewallRule(rule *store.FirewallRule) error {
+	if rule.Name == "" {
+		return errors.New("name is required")
+	}
+
+	if rule.ProxyRole != "" && !isValidRole(UserRole(rule.ProxyRole)) {
+		return errors.New("invalid proxy_role")
+	}
+
+	types := listOf(rule.StatementTypes)
+	for i, t := range types {
+		types[i] = strings.Join(strings.Fields(strings.ToUpper(t)), " ")
+	}
+
+	rule.StatementTypes = strings.Join(types, ",")
+	rule.Schemas = strings.Join(listOf(rule.Schemas), ",")
+
+	// a rule without a condition would block every statement
+	if rule.StatementTypes == "" && rule.Schemas == "" && !rule.MissingWhere && !rule.CopyProgram {
+		return errors.New("at least one of statement_types, schemas, missing_where or copy_program is required")
+	}
+
+	if (rule.WindowStart == "") != (rule.WindowEnd == "") {
+		return errors.New("window_start and window_end go together")
+	}
+
+	for _, bound := range []string{rule.WindowStart, rule.WindowEnd} {
+		if _, err := time.Parse(windowLayout, bound); bound != "" && err != nil {
+			return fmt.Errorf("invalid window bound %q, expected HH:MM", bound)
+		}
+	}
+
+	return nil
+}
+
+// listOf splits a comma-separated list, dropping empty items
+func listOf(list string) []string {
+	var items []string
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
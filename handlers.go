@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -13,7 +14,9 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 
+	"thesis/sqlparser"
 	"thesis/store"
 )
 
@@ -68,15 +71,23 @@ func (p *Proxy) handleSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	scramVerifier, err := scramVerifierFor(user.Password)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("Failed to derive SCRAM verifier")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	u := store.User{
-		ID:        uuid.New(),
-		Username:  user.Username,
-		Password:  string(hashedPassword),
-		IsAdmin:   false,
-		Role:      user.Role,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		DeletedAt: nil,
+		ID:            uuid.New(),
+		Username:      user.Username,
+		Password:      string(hashedPassword),
+		ScramVerifier: scramVerifier,
+		IsAdmin:       false,
+		Role:          user.Role,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+		DeletedAt:     nil,
 	}
 
 	// Insert user
@@ -338,7 +349,15 @@ func (p *Proxy) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		scramVerifier, err := scramVerifierFor(user.Password)
+		if err != nil {
+			p.logger.Error().Err(err).Msg("Failed to derive SCRAM verifier")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		fetched.Password = string(hashedPassword)
+		fetched.ScramVerifier = scramVerifier
 	}
 
 	if user.Role != "" {
@@ -390,6 +409,11 @@ func (p *Proxy) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// users created before SCRAM have no verifier until they next log in here
+	if fetched.ScramVerifier == "" {
+		p.backfillScramVerifier(ctx, requestID, fetched, credential.Password)
+	}
+
 	// Generate JWT
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"username": credential.Username,
@@ -682,3 +706,582 @@ func (p *Proxy) handleFetchSQL(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(result)
 }
+
+// handleCreateCredential stores the database login used for a proxy user or role (admin-only)
+func (p *Proxy) handleCreateCredential(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for create-credential")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted create-credential", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	var credential struct {
+		ProxyUser  string `json:"proxy_user"`
+		ProxyRole  string `json:"proxy_role"`
+		DBUser     string `json:"db_user"`
+		DBPassword string `json:"db_password"`
+	}
+
+	if err = json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		p.logger.Warn().Err(err).Msg("Failed to decode create-credential request")
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Validate input
+	if credential.DBUser == "" || credential.DBPassword == "" {
+		p.logger.Warn().Msg("Missing required fields in create-credential request")
+		http.Error(w, "db_user and db_password are required", http.StatusBadRequest)
+		return
+	}
+
+	if (credential.ProxyUser == "") == (credential.ProxyRole == "") {
+		p.logger.Warn().Msg("Credential must be for exactly one of a user or a role")
+		http.Error(w, "Exactly one of proxy_user or proxy_role is required", http.StatusBadRequest)
+		return
+	}
+
+	if credential.ProxyRole != "" && !isValidRole(UserRole(credential.ProxyRole)) {
+		p.logger.Warn().Msgf("Invalid role %s in create-credential request", credential.ProxyRole)
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	created, err := p.store.credentialStore.Create(ctx, requestID, store.UpstreamCredential{
+		ID:         uuid.New(),
+		ProxyUser:  credential.ProxyUser,
+		ProxyRole:  credential.ProxyRole,
+		DBUser:     credential.DBUser,
+		DBPassword: credential.DBPassword,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			p.logger.Warn().Msg("Upstream credential already exists")
+			http.Error(w, "A credential for this user or role already exists", http.StatusConflict)
+			return
+		}
+
+		p.logger.Error().Err(err).Msg("Failed to create upstream credential")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	p.logger.Info().Msgf("Upstream credential %v created by %s", created.ID, username)
+	w.WriteHeader(http.StatusCreated)
+
+	_ = json.NewEncoder(w).Encode(created)
+}
+
+// handleFetchCredentials lists the upstream credentials without their passwords (admin-only)
+func (p *Proxy) handleFetchCredentials(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for fetch-credentials")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted fetch-credentials", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+
+	pageSize, err := strconv.Atoi(query.Get("page_size"))
+	if err != nil || pageSize <= 0 {
+		pageSize = 10 // default
+	}
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page <= 0 {
+		page = 1 // default
+	}
+
+	result, err := p.store.credentialStore.GetPaginatedCredentials(ctx, requestID, page, pageSize)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("Failed to get upstream credentials")
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// handleDeleteCredential removes an upstream credential (admin-only)
+func (p *Proxy) handleDeleteCredential(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	credentialID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid credential ID")
+		http.Error(w, "Invalid or missing credential ID", http.StatusBadRequest)
+		return
+	}
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for delete-credential")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted delete-credential", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	if err = p.store.credentialStore.Delete(ctx, requestID, credentialID); err != nil {
+		p.logger.Error().Err(err).Msgf("Failed to delete upstream credential %v", credentialID)
+		http.Error(w, "credential not found", http.StatusNotFound)
+		return
+	}
+
+	p.logger.Info().Msgf("Upstream credential %v deleted by %s", credentialID, username)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": "Credential deleted successfully"})
+}
+
+// handleCreateFirewallRule adds a rule to the query firewall and puts it in
+// force (admin-only)
+func (p *Proxy) handleCreateFirewallRule(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for create-firewall-rule")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted create-firewall-rule", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	var rule struct {
+		Name           string `json:"name"`
+		ProxyUser      string `json:"proxy_user"`
+		ProxyRole      string `json:"proxy_role"`
+		StatementTypes string `json:"statement_types"`
+		Schemas        string `json:"schemas"`
+		MissingWhere   bool   `json:"missing_where"`
+		CopyProgram    bool   `json:"copy_program"`
+		WindowStart    string `json:"window_start"`
+		WindowEnd      string `json:"window_end"`
+	}
+
+	if err = json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		p.logger.Warn().Err(err).Msg("Failed to decode create-firewall-rule request")
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	payload := store.FirewallRule{
+		ID:             uuid.New(),
+		Name:           rule.Name,
+		ProxyUser:      rule.ProxyUser,
+		ProxyRole:      rule.ProxyRole,
+		StatementTypes: rule.StatementTypes,
+		Schemas:        rule.Schemas,
+		MissingWhere:   rule.MissingWhere,
+		CopyProgram:    rule.CopyProgram,
+		WindowStart:    rule.WindowStart,
+		WindowEnd:      rule.WindowEnd,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+
+	// Validate input
+	if err = validateFirewallRule(&payload); err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid create-firewall-rule request")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	created, err := p.store.firewallStore.Create(ctx, requestID, payload)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("Failed to create firewall rule")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err = p.loadFirewallRules(ctx, requestID); err != nil {
+		p.logger.Error().Err(err).Msg("Failed to reload firewall rules")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	p.logger.Info().Msgf("Firewall rule %v created by %s", created.ID, username)
+	w.WriteHeader(http.StatusCreated)
+
+	_ = json.NewEncoder(w).Encode(created)
+}
+
+// handleFetchFirewallRules lists the query firewall rules (admin-only)
+func (p *Proxy) handleFetchFirewallRules(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for fetch-firewall-rules")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted fetch-firewall-rules", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+
+	pageSize, err := strconv.Atoi(query.Get("page_size"))
+	if err != nil || pageSize <= 0 {
+		pageSize = 10 // default
+	}
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page <= 0 {
+		page = 1 // default
+	}
+
+	result, err := p.store.firewallStore.GetPaginatedRules(ctx, requestID, page, pageSize)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("Failed to get firewall rules")
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// handleDeleteFirewallRule removes a rule from the query firewall and lifts
+// it (admin-only)
+func (p *Proxy) handleDeleteFirewallRule(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	ruleID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid firewall rule ID")
+		http.Error(w, "Invalid or missing firewall rule ID", http.StatusBadRequest)
+		return
+	}
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for delete-firewall-rule")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted delete-firewall-rule", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	if err = p.store.firewallStore.Delete(ctx, requestID, ruleID); err != nil {
+		p.logger.Error().Err(err).Msgf("Failed to delete firewall rule %v", ruleID)
+		http.Error(w, "firewall rule not found", http.StatusNotFound)
+		return
+	}
+
+	if err = p.loadFirewallRules(ctx, requestID); err != nil {
+		p.logger.Error().Err(err).Msg("Failed to reload firewall rules")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	p.logger.Info().Msgf("Firewall rule %v deleted by %s", ruleID, username)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": "Firewall rule deleted successfully"})
+}
+
+// handleApproveQuery allows the fingerprints of the statements of a query for
+// a proxy user, whether or not the user sent them before (admin-only)
+func (p *Proxy) handleApproveQuery(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for approve-query")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted approve-query", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	var approval struct {
+		ProxyUser string `json:"proxy_user"`
+		Query     string `json:"query"`
+	}
+
+	if err = json.NewDecoder(r.Body).Decode(&approval); err != nil {
+		p.logger.Warn().Err(err).Msg("Failed to decode approve-query request")
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Validate input
+	if approval.ProxyUser == "" || approval.Query == "" {
+		p.logger.Warn().Msg("Missing required fields in approve-query request")
+		http.Error(w, "proxy_user and query are required", http.StatusBadRequest)
+		return
+	}
+
+	_, query := parseHints(approval.Query)
+
+	statements, err := sqlparser.Parse(query)
+	if err != nil || len(statements) == 0 {
+		p.logger.Warn().Err(err).Msg("Unparsable query in approve-query request")
+		http.Error(w, "query holds no statement", http.StatusBadRequest)
+		return
+	}
+
+	approved := make([]store.AllowlistEntry, 0, len(statements))
+
+	for _, statement := range statements {
+		entry, err := p.store.allowlistStore.Put(ctx, requestID, store.AllowlistEntry{
+			ID:          uuid.New(),
+			ProxyUser:   approval.ProxyUser,
+			Fingerprint: statement.Fingerprint,
+			Query:       statement.Normalized,
+			Status:      FingerprintAllowed,
+			CreatedAt:   time.Now(),
+			UpdatedAt:   time.Now(),
+		})
+		if err != nil {
+			p.logger.Error().Err(err).Msg("Failed to approve query fingerprint")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		p.allowlist.set(*entry)
+		approved = append(approved, *entry)
+	}
+
+	p.logger.Info().Msgf("%d query fingerprints of %s approved by %s", len(approved), approval.ProxyUser, username)
+	w.WriteHeader(http.StatusCreated)
+
+	_ = json.NewEncoder(w).Encode(approved)
+}
+
+// handleFetchAllowlist lists the query fingerprints users sent, optionally
+// those of one proxy_user or with one status (admin-only)
+func (p *Proxy) handleFetchAllowlist(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for fetch-allowlist")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted fetch-allowlist", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+
+	pageSize, err := strconv.Atoi(query.Get("page_size"))
+	if err != nil || pageSize <= 0 {
+		pageSize = 10 // default
+	}
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page <= 0 {
+		page = 1 // default
+	}
+
+	result, err := p.store.allowlistStore.GetPaginatedEntries(ctx, requestID, query.Get("proxy_user"), query.Get("status"), page, pageSize)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("Failed to get query allowlist")
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// handleApproveFingerprint allows a query fingerprint a user sent (admin-only)
+func (p *Proxy) handleApproveFingerprint(w http.ResponseWriter, r *http.Request) {
+	p.setFingerprintStatus(w, r, FingerprintAllowed, "approve-fingerprint")
+}
+
+// handleRevokeFingerprint stops allowing a query fingerprint (admin-only)
+func (p *Proxy) handleRevokeFingerprint(w http.ResponseWriter, r *http.Request) {
+	p.setFingerprintStatus(w, r, FingerprintRevoked, "revoke-fingerprint")
+}
+
+func (p *Proxy) setFingerprintStatus(w http.ResponseWriter, r *http.Request, status, action string) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	entryID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid allowlist entry ID")
+		http.Error(w, "Invalid or missing allowlist entry ID", http.StatusBadRequest)
+		return
+	}
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msgf("Invalid or missing token for %s", action)
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted %s", username, role, action)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	entry, err := p.store.allowlistStore.SetStatus(ctx, requestID, entryID, status)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "allowlist entry not found", http.StatusNotFound)
+			return
+		}
+
+		p.logger.Error().Err(err).Msgf("Failed to set status of allowlist entry %v", entryID)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	p.allowlist.set(*entry)
+	p.logger.Info().Msgf("Query fingerprint %s of %s set to %s by %s", entry.Fingerprint, entry.ProxyUser, status, username)
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(entry)
+}
+
+// handleGetSessionStats reports client sessions and how many of them are
+// pinned to a backend (admin-only)
+func (p *Proxy) handleGetSessionStats(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for session-stats")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted session-stats", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(p.sessionStats())
+}
+
+// handleGetQueryStats reports the limit statement fingerprints with the
+// highest value in the sort column, with their counters by user and by
+// upstream (admin-only)
+func (p *Proxy) handleGetQueryStats(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for query-stats")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted query-stats", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "calls" // default
+	}
+
+	if !slices.Contains(queryStatsColumns, sort) {
+		http.Error(w, "sort must be one of "+strings.Join(queryStatsColumns, ", "), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 10 // default
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(p.queryStats.top(sort, limit))
+}
+
+// handleGetPoolStats reports the connection pool of every upstream, with the
+// clients waiting for a backend session (admin-only)
+func (p *Proxy) handleGetPoolStats(w http.ResponseWriter, r *http.Request) {
+	ctx, requestID := r.Context(), uuid.New()
+
+	// Validate JWT and ensure admin role
+	username, role, err := p.validateJWTFromHeader(ctx, requestID, r)
+	if err != nil {
+		p.logger.Warn().Err(err).Msg("Invalid or missing token for pool-stats")
+		http.Error(w, "Invalid or missing token", http.StatusUnauthorized)
+		return
+	}
+
+	if role != UserRoleAdmin {
+		p.logger.Warn().Msgf("User %s with role %s attempted pool-stats", username, role)
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(p.poolStats())
+}
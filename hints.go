@@ -0,0 +1,117 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Hints a statement may carry in a leading /* goxy:name=value */ comment
+const (
+	HintRoute       = "route"       // primary or replica, whatever the statement is
+	HintUpstream    = "upstream"    // the upstream of that name
+	HintConsistency = "consistency" // the session's read-your-writes mode from here on
+)
+
+// Targets of a route hint
+const (
+	RoutePrimary = "primary"
+	RouteReplica = "replica"
+)
+
+// hintPattern matches a leading /* goxy:name=value ... */ comment
+var hintPattern = regexp.MustCompile(`^\s*/\*\s*goxy:(.*?)\*/`)
+
+// parseHints returns the name=value hints in the leading goxy: comments of
+// query, and the query without them. Several hints may share a comment, as
+// in /* goxy:route=primary goxy:consistency=lsn */.
+func parseHints(query string) (map[string]string, string) {
+	var hints map[string]string
+
+	for {
+		match := hintPattern.FindStringSubmatchIndex(query)
+		if match == nil {
+			return hints, query
+		}
+
+		for _, field := range strings.Fields(query[match[2]:match[3]]) {
+			name, value, ok := strings.Cut(strings.TrimPrefix(field, "goxy:"), "=")
+			if !ok {
+				continue
+			}
+
+			if hints == nil {
+				hints = make(map[string]string)
+			}
+
+			hints[strings.ToLower(name)] = value
+		}
+
+		query = query[match[1]:]
+	}
+}
+
+// formatHints renders hints the way they are recorded with a statement
+func formatHints(hints map[string]string) string {
+	fields := make([]string, 0, len(hints))
+	for name, value := range hints {
+		fields = append(fields, name+"="+value)
+	}
+
+	slices.Sort(fields)
+
+	return strings.Join(fields, " ")
+}
+
+// statementClass classifies a query the way its routing hints say, falling
+// back to classifyQuery without them. A query sent to a named replica also
+// returns that replica, which its reads then go to.
+func (p *Proxy) statementClass(query string) (QueryClass, *Upstream) {
+	hints, _ := parseHints(query)
+
+	if class, upstream, ok := p.hintedClass(hints); ok {
+		return class, upstream
+	}
+
+	return p.classifyQuery(query), nil
+}
+
+// hintedClass returns the class routing hints give a query and the replica
+// they name, if any. ok is false when the hints do not route the query;
+// hints that name an unknown, unhealthy or lagging upstream are ignored.
+func (p *Proxy) hintedClass(hints map[string]string) (class QueryClass, upstream *Upstream, ok bool) {
+	if name, named := hints[HintUpstream]; named {
+		if upstream = p.upstreamByName(name); upstream != nil {
+			if upstream.Role == UpstreamPrimary {
+				return QueryWrite, nil, true
+			}
+
+			return QueryRead, upstream, true
+		}
+	}
+
+	switch strings.ToLower(hints[HintRoute]) {
+	case RoutePrimary:
+		return QueryWrite, nil, true
+	case RouteReplica:
+		return QueryRead, nil, true
+	}
+
+	return QueryUnknown, nil, false
+}
+
+// upstreamByName returns the primary or replica of the given name, or nil
+// when there is none or it cannot take the query: it failed its last health
+// check, or it is a replica lagging beyond REPLICA_MAX_LAG
+func (p *Proxy) upstreamByName(name string) *Upstream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, upstream := range append([]*Upstream{p.primary}, p.servers...) {
+		if upstream.Name == name && upstream.usable() {
+			return upstream
+		}
+	}
+
+	return nil
+}
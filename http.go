@@ -21,6 +21,22 @@ func (p *Proxy) HTTPServer() error {
 	r.HandleFunc("/users", p.handleFetchUsers).Methods("GET")
 	r.HandleFunc("/users/{id}", p.handleGetUser).Methods("GET")
 
+	// Upstream credentials
+	r.HandleFunc("/credentials", p.handleCreateCredential).Methods("POST")
+	r.HandleFunc("/credentials", p.handleFetchCredentials).Methods("GET")
+	r.HandleFunc("/credentials/{id}", p.handleDeleteCredential).Methods("DELETE")
+
+	// Query firewall
+	r.HandleFunc("/firewall/rules", p.handleCreateFirewallRule).Methods("POST")
+	r.HandleFunc("/firewall/rules", p.handleFetchFirewallRules).Methods("GET")
+	r.HandleFunc("/firewall/rules/{id}", p.handleDeleteFirewallRule).Methods("DELETE")
+
+	// Query allowlist
+	r.HandleFunc("/allowlist", p.handleApproveQuery).Methods("POST")
+	r.HandleFunc("/allowlist", p.handleFetchAllowlist).Methods("GET")
+	r.HandleFunc("/allowlist/{id}/approve", p.handleApproveFingerprint).Methods("PUT")
+	r.HandleFunc("/allowlist/{id}/revoke", p.handleRevokeFingerprint).Methods("PUT")
+
 	//Logs
 	r.HandleFunc("/logs", p.handleGetLogs).Methods("GET")
 	r.HandleFunc("/logs/{request_id}", p.handleGetLogsByRequestID).Methods("GET")
@@ -33,6 +49,11 @@ func (p *Proxy) HTTPServer() error {
 	r.HandleFunc("/sql", p.handleFetchSQL).Methods("GET")
 	r.HandleFunc("/sql/{request_id}", p.handleFetchRequestSQL).Methods("GET")
 
+	// Stats
+	r.HandleFunc("/stats/sessions", p.handleGetSessionStats).Methods("GET")
+	r.HandleFunc("/stats/pools", p.handleGetPoolStats).Methods("GET")
+	r.HandleFunc("/stats/queries", p.handleGetQueryStats).Methods("GET")
+
 	p.logger.Info().Msgf("HTTP server listening on %s", p.config.HTTPListen)
 
 	return http.ListenAndServe(p.config.HTTPListen, r)
@@ -1,14 +1,266 @@
 package main
 
-import "sync/atomic"
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 
-// round-robin load balancer
-func (p *Proxy) getNextServer() *Upstream {
-	if len(p.servers) == 0 {
+	"github.com/google/uuid"
+)
+
+// Load-balancing strategies, chosen with REPLICA_BALANCER
+const (
+	BalanceRoundRobin         = "round_robin"
+	BalanceWeightedRoundRobin = "weighted_round_robin"
+	BalanceLeastConnections   = "least_connections"
+	BalanceLowestLatency      = "lowest_latency"
+	BalanceConsistentHash     = "consistent_hash"
+)
+
+// What consistent hashing keeps together on one upstream
+const (
+	HashOnUser     = "user"
+	HashOnClientIP = "client_ip"
+)
+
+// Balancer picks the upstream a client's new backend session is opened on
+type Balancer interface {
+	// Pick returns one of upstreams, which is never empty
+	Pick(upstreams []*Upstream, key BalanceKey) *Upstream
+}
+
+// BalanceKey is what a Balancer knows about the client it picks for
+type BalanceKey struct {
+	User     string // the proxy user, not the database user it logs in as
+	ClientIP string
+}
+
+// BalancerConfig is the strategy reads are spread over a replica group with.
+// REPLICA_BALANCER applies to clients reading from every replica and
+// REPLICA_BALANCER_<GROUP> to a group's replicas, falling back to
+// REPLICA_BALANCER. Both take the form strategy?hash_on=client_ip; hash_on
+// only applies to consistent_hash.
+type BalancerConfig struct {
+	strategy string
+	hashOn   string // user or client_ip
+}
+
+// parseBalancerConfig splits a balancer entry into its strategy and options
+func parseBalancerConfig(raw string) BalancerConfig {
+	strategy, query, _ := strings.Cut(strings.TrimSpace(raw), "?")
+	balancer := BalancerConfig{strategy: strategy, hashOn: HashOnUser}
+
+	if balancer.strategy == "" {
+		balancer.strategy = BalanceRoundRobin
+	}
+
+	options, _ := url.ParseQuery(query)
+
+	if v := options.Get("hash_on"); v != "" {
+		balancer.hashOn = v
+	}
+
+	return balancer
+}
+
+// balancerVariable names the environment variable that sets a replica
+// group's strategy
+func balancerVariable(group string) string {
+	if group == "" {
+		return "REPLICA_BALANCER"
+	}
+
+	return "REPLICA_BALANCER_" + strings.ToUpper(group)
+}
+
+func newBalancer(config BalancerConfig) (Balancer, error) {
+	switch config.strategy {
+	case BalanceRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case BalanceWeightedRoundRobin:
+		return &weightedRoundRobinBalancer{current: make(map[uuid.UUID]int)}, nil
+	case BalanceLeastConnections:
+		return leastConnectionsBalancer{}, nil
+	case BalanceLowestLatency:
+		return lowestLatencyBalancer{}, nil
+	case BalanceConsistentHash:
+		if config.hashOn != HashOnUser && config.hashOn != HashOnClientIP {
+			return nil, fmt.Errorf("invalid hash_on %q, want %s or %s", config.hashOn, HashOnUser, HashOnClientIP)
+		}
+
+		return consistentHashBalancer{hashOn: config.hashOn}, nil
+	default:
+		return nil, fmt.Errorf("unknown load-balancing strategy %q", config.strategy)
+	}
+}
+
+// pickReplica picks the healthy replica a session's reads go to with the
+// balancer of its replica group, or nil when there is none
+func (p *Proxy) pickReplica(session *Session) *Upstream {
+	servers := p.readableReplicas(session)
+	if len(servers) == 0 {
 		return nil
 	}
 
-	i := atomic.AddUint64(&p.serverIndex, 1)
+	key := BalanceKey{User: session.username}
+	if host, _, err := net.SplitHostPort(session.request.conn.RemoteAddr().String()); err == nil {
+		key.ClientIP = host
+	}
+
+	return p.balancers[session.request.replicaGroup].Pick(servers, key)
+}
+
+// readableReplicas returns the healthy replicas of its replica group a
+// session may read from. Replicas lagging too far behind the primary are left out until they catch
+// up, and so are the ones that have not replayed the session's last write
+// when it reads its own writes.
+func (p *Proxy) readableReplicas(session *Session) []*Upstream {
+	group := session.request.replicaGroup
+
+	p.lock.Lock()
+	servers := make([]*Upstream, 0, len(p.servers))
+
+	for _, upstream := range p.servers {
+		if (group == "" || upstream.Group == group) && !upstream.isLagging() {
+			servers = append(servers, upstream)
+		}
+	}
+
+	p.lock.Unlock()
+
+	if session.consistency != ConsistencyLSN || session.writeLSN == 0 {
+		return servers
+	}
+
+	return slices.DeleteFunc(servers, func(upstream *Upstream) bool {
+		return !p.replicaCaughtUp(session, upstream, session.writeLSN)
+	})
+}
+
+// roundRobinBalancer takes the upstreams in turn
+type roundRobinBalancer struct {
+	index uint64
+}
+
+func (b *roundRobinBalancer) Pick(upstreams []*Upstream, _ BalanceKey) *Upstream {
+	i := atomic.AddUint64(&b.index, 1)
+
+	return upstreams[i%uint64(len(upstreams))]
+}
+
+// weightedRoundRobinBalancer takes the upstreams in turn, each in proportion
+// to its weight, spreading the picks of a heavy upstream out instead of
+// taking them back to back (the smooth variant nginx uses)
+type weightedRoundRobinBalancer struct {
+	lock    sync.Mutex
+	current map[uuid.UUID]int
+}
+
+func (b *weightedRoundRobinBalancer) Pick(upstreams []*Upstream, _ BalanceKey) *Upstream {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var (
+		best  *Upstream
+		total int
+	)
+
+	for _, upstream := range upstreams {
+		b.current[upstream.ID] += upstream.Weight
+		total += upstream.Weight
+
+		if best == nil || b.current[upstream.ID] > b.current[best.ID] {
+			best = upstream
+		}
+	}
+
+	b.current[best.ID] -= total
+
+	return best
+}
+
+// leastConnectionsBalancer picks the upstream with the fewest sessions in
+// use relative to its weight
+type leastConnectionsBalancer struct{}
+
+func (leastConnectionsBalancer) Pick(upstreams []*Upstream, _ BalanceKey) *Upstream {
+	best, bestInUse := upstreams[0], -1
+
+	for _, upstream := range upstreams {
+		inUse := upstream.inUse()
+		if inUse < 0 {
+			continue
+		}
+
+		// inUse/Weight < bestInUse/best.Weight, without dividing
+		if bestInUse < 0 || inUse*best.Weight < bestInUse*upstream.Weight {
+			best, bestInUse = upstream, inUse
+		}
+	}
+
+	return best
+}
+
+// lowestLatencyBalancer picks the upstream that answered the last health
+// check fastest, and among equally fast ones the least busy
+type lowestLatencyBalancer struct{}
+
+func (lowestLatencyBalancer) Pick(upstreams []*Upstream, _ BalanceKey) *Upstream {
+	best, bestLag, bestInUse := upstreams[0], -1, 0
+
+	for _, upstream := range upstreams {
+		lag, inUse := upstream.latency(), upstream.inUse()
+		if inUse < 0 {
+			continue
+		}
+
+		if bestLag < 0 || lag < bestLag || (lag == bestLag && inUse < bestInUse) {
+			best, bestLag, bestInUse = upstream, lag, inUse
+		}
+	}
+
+	return best
+}
+
+// consistentHashBalancer sends each user or client IP to the same upstream
+// for as long as it stays healthy. It uses weighted rendezvous hashing, so an
+// upstream leaving or joining only moves the clients it loses or gains.
+type consistentHashBalancer struct {
+	hashOn string
+}
+
+func (b consistentHashBalancer) Pick(upstreams []*Upstream, key BalanceKey) *Upstream {
+	value := key.User
+	if b.hashOn == HashOnClientIP {
+		value = key.ClientIP
+	}
+
+	var (
+		best      *Upstream
+		bestScore float64
+	)
+
+	for _, upstream := range upstreams {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(value))
+		_, _ = hash.Write([]byte{0})
+		_, _ = hash.Write([]byte(upstream.Addr))
+
+		// a uniform number in (0, 1) turned into a score that a heavier
+		// upstream wins proportionally more often
+		u := (float64(hash.Sum64()>>11) + 0.5) / (1 << 53)
+		score := float64(upstream.Weight) / -math.Log(u)
+
+		if best == nil || score > bestScore {
+			best, bestScore = upstream, score
+		}
+	}
 
-	return p.servers[i%uint64(len(p.servers))]
+	return best
 }
@@ -3,10 +3,19 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 )
 
+// maxMessageLength caps a single protocol message at 1 GB, the same limit
+// PostgresSQL enforces on its own connections.
+const maxMessageLength = 1 << 30
+
+// maxStartupLength caps the startup packet, as PostgreSQL does
+const maxStartupLength = 10000
+
 func readStartupMessage(conn net.Conn) ([]byte, error) {
 	// First 4 bytes: length
 	lenBuf := make([]byte, 4)
@@ -15,6 +24,11 @@ func readStartupMessage(conn net.Conn) ([]byte, error) {
 	}
 	length := binary.BigEndian.Uint32(lenBuf)
 
+	// a startup packet carries at least the protocol code; PostgreSQL caps it at 10 KB
+	if length < 8 || length > maxStartupLength {
+		return nil, fmt.Errorf("invalid startup packet length %d", length)
+	}
+
 	// Read rest
 	msg := make([]byte, length-4)
 	if _, err := io.ReadFull(conn, msg); err != nil {
@@ -24,6 +38,36 @@ func readStartupMessage(conn net.Conn) ([]byte, error) {
 	return append(lenBuf, msg...), nil
 }
 
+// readMessage reads one complete length-prefixed message (type byte, int32
+// length, body) from reader. Several messages packed into one TCP segment and
+// one message split across several segments both come out whole.
+func readMessage(reader io.Reader) ([]byte, error) {
+	return readMessageLimit(reader, maxMessageLength)
+}
+
+// readMessageLimit is readMessage for messages of at most limit bytes
+func readMessageLimit(reader io.Reader, limit int) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	// length includes itself but not the type byte
+	length := int(binary.BigEndian.Uint32(header[1:5]))
+	if length < 4 || length > limit {
+		return nil, fmt.Errorf("invalid length %d for message type %q", length, header[0])
+	}
+
+	msg := make([]byte, 1+length)
+	copy(msg, header)
+
+	if _, err := io.ReadFull(reader, msg[5:]); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
 func parseTheStartupMessage(msg []byte) (map[string]string, uint32) {
 	protocol := binary.BigEndian.Uint32(msg[4:8])
 	params := map[string]string{}
@@ -73,6 +117,12 @@ func buildStartupMessage(params map[string]string, protocol uint32) []byte {
 }
 
 func writeError(conn net.Conn, severity, code, msg string) error {
+	_, err := conn.Write(encodeError(severity, code, msg))
+	return err
+}
+
+// encodeError builds an ErrorResponse message
+func encodeError(severity, code, msg string) []byte {
 	buf := new(bytes.Buffer)
 
 	// Type
@@ -86,6 +136,10 @@ func writeError(conn net.Conn, severity, code, msg string) error {
 	buf.WriteString(severity)
 	buf.WriteByte(0)
 
+	buf.WriteByte('V')
+	buf.WriteString(severity)
+	buf.WriteByte(0)
+
 	buf.WriteByte('C')
 	buf.WriteString(code)
 	buf.WriteByte(0)
@@ -101,6 +155,58 @@ func writeError(conn net.Conn, severity, code, msg string) error {
 	length := int32(len(data) - 1) // length excludes type byte
 	binary.BigEndian.PutUint32(data[1:5], uint32(length))
 
-	_, err := conn.Write(data)
-	return err
+	return data
+}
+
+// encodeReadyForQuery builds a ReadyForQuery message with the given transaction status ('I', 'T' or 'E')
+func encodeReadyForQuery(status byte) []byte {
+	return []byte{'Z', 0, 0, 0, 5, status}
+}
+
+// startupSettings returns the run-time parameters of a startup message, the
+// ones other than the user, database and replication mode, with their values
+// as SQL literals. Settings passed as -c name=value in options are included too.
+func startupSettings(params map[string]string) map[string]string {
+	settings := make(map[string]string)
+
+	for name, value := range params {
+		switch name {
+		case "user", "database", "replication":
+		case "options":
+			fields := strings.Fields(value)
+			for i := 0; i < len(fields); i++ {
+				option := fields[i]
+
+				switch {
+				case option == "-c" && i+1 < len(fields):
+					i++
+					option = fields[i]
+				case strings.HasPrefix(option, "--"):
+					option = option[2:]
+				case strings.HasPrefix(option, "-c"):
+					option = option[2:]
+				default:
+					continue
+				}
+
+				if name, value, ok := strings.Cut(option, "="); ok {
+					settings[strings.ReplaceAll(name, "-", "_")] = quoteLiteral(value)
+				}
+			}
+		default:
+			settings[name] = quoteLiteral(value)
+		}
+	}
+
+	return settings
+}
+
+// quoteIdentifier quotes a name for use in a SQL statement
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes a string constant for use in a SQL statement
+func quoteLiteral(value string) string {
+	return `'` + strings.ReplaceAll(value, `'`, `''`) + `'`
 }
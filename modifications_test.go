@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadMessage(t *testing.T) {
+	query := encodeSimpleQuery("SELECT 1")
+	sync := []byte{'S', 0, 0, 0, 4}
+
+	tests := []struct {
+		name   string
+		reader io.Reader
+		want   [][]byte
+	}{
+		{"one message", bytes.NewReader(query), [][]byte{query}},
+		{"byte by byte", iotest.OneByteReader(bytes.NewReader(query)), [][]byte{query}},
+		{"back to back", bytes.NewReader(append(append([]byte{}, query...), sync...)), [][]byte{query, sync}},
+		{"split across reads", iotest.HalfReader(bytes.NewReader(append(append([]byte{}, sync...), query...))), [][]byte{sync, query}},
+	}
+
+	for _, test := range tests {
+		for i, want := range test.want {
+			got, err := readMessage(test.reader)
+			if err != nil {
+				t.Fatalf("%s: message %d: %v", test.name, i, err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: message %d = %q, want %q", test.name, i, got, want)
+			}
+		}
+
+		if _, err := readMessage(test.reader); !errors.Is(err, io.EOF) {
+			t.Errorf("%s: read past the last message = %v, want io.EOF", test.name, err)
+		}
+	}
+}
+
+func TestReadMessageInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		limit int
+		want  error // nil for any error
+	}{
+		{"length below its own size", []byte{'Q', 0, 0, 0, 3}, maxMessageLength, nil},
+		{"length over the limit", []byte{'Q', 0, 0, 0, 9, 'a', 'b', 'c', 'd', 'e'}, 8, nil},
+		{"truncated header", []byte{'Q', 0, 0}, maxMessageLength, io.ErrUnexpectedEOF},
+		{"truncated body", []byte{'Q', 0, 0, 0, 9, 'a', 'b'}, maxMessageLength, io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		_, err := readMessageLimit(bytes.NewReader(test.input), test.limit)
+		if err == nil {
+			t.Errorf("%s: read succeeded, want an error", test.name)
+			continue
+		}
+
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: error = %v, want %v", test.name, err, test.want)
+		}
+	}
+}
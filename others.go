@@ -6,19 +6,105 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog"
 )
 
 type Upstream struct {
 	Addr    string
+	Name    string // what routing hints call it
+	Role    UpstreamRole
 	Healthy bool
-	Lag     int
+	Lag     int    // round trip of the last health check in milliseconds
+	Weight  int    // share of the clients the balancer sends here, relative to the other replicas
+	Group   string // replica group the upstream belongs to
 	lock    sync.Mutex
 	ID      uuid.UUID
-	pool    *ConnectionPool
+	pool    atomic.Pointer[ConnectionPool] // nil until the upstream first answers
 	config  PoolConfig
+
+	// replication as of the last health check that could log in
+	ReplicationLag time.Duration // how far replay trails the primary
+	lagging        bool          // ReplicationLag is beyond REPLICA_MAX_LAG, so reads avoid it
+	replayLSN      uint64        // WAL position the replica had replayed when last asked
+}
+
+// newUpstream creates an upstream together with its connection pool. An
+// upstream that does not answer starts out unhealthy, and the health checker
+// brings it back once it answers again.
+func newUpstream(config UpstreamConfig, role UpstreamRole, poolConf PoolConfig, logger zerolog.Logger) *Upstream {
+	addr := config.addr
+
+	upstream := &Upstream{
+		Addr:    addr,
+		Name:    config.name,
+		Role:    role,
+		Healthy: false,
+		Lag:     0,
+		Weight:  config.weight,
+		Group:   config.group,
+		lock:    sync.Mutex{},
+		ID:      uuid.New(),
+		config:  poolConf,
+	}
+
+	if err := checkUpstream(upstream); err != nil {
+		logger.Error().Err(err).Msgf("Failed to connect to upstream %v: %v", addr, err)
+		return upstream
+	}
+
+	pool, err := NewConnectionPool(poolConf)
+	if err != nil {
+		logger.Error().Err(err).Msgf("Failed to create pool for upstream %v: %v", addr, err)
+		return upstream
+	}
+
+	upstream.pool.Store(pool)
+	upstream.Healthy = true
+
+	return upstream
+}
+
+// latency returns the round trip of the last health check in milliseconds
+func (u *Upstream) latency() int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.Lag
+}
+
+// isLagging reports whether the replica trails the primary by more than
+// REPLICA_MAX_LAG
+func (u *Upstream) isLagging() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.lagging
+}
+
+// usable reports whether the upstream answered its last health check and is
+// not lagging beyond REPLICA_MAX_LAG
+func (u *Upstream) usable() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.Healthy && !u.lagging
+}
+
+// inUse returns how many of the upstream's pooled sessions are checked out,
+// or -1 when it has no pool
+func (u *Upstream) inUse() int {
+	pool := u.pool.Load()
+	if pool == nil {
+		return -1
+	}
+
+	stats := pool.Stats()
+
+	return stats.Open - stats.Idle
 }
 
 func boolToInt(b bool) int {
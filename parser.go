@@ -203,3 +203,48 @@ func parsePostgresDataRow(data []byte) (string, error) {
 
 	return strings.Join(values, ", "), nil
 }
+
+// parseParseMessage extracts the statement name, query text and parameter type OIDs from a Parse message
+func parseParseMessage(data []byte) (string, string, []uint32, error) {
+	if len(data) < 6 || data[0] != 'P' {
+		return "", "", nil, fmt.Errorf("not a Parse message")
+	}
+
+	// skip type + length
+	pos := 5
+
+	// read statement name (null-terminated)
+	end := bytes.IndexByte(data[pos:], 0)
+	if end < 0 {
+		return "", "", nil, fmt.Errorf("invalid statement name")
+	}
+	name := string(data[pos : pos+end])
+	pos += end + 1
+
+	// read query string (null-terminated)
+	end = bytes.IndexByte(data[pos:], 0)
+	if end < 0 {
+		return name, "", nil, fmt.Errorf("invalid query string")
+	}
+	query := string(data[pos : pos+end])
+	pos += end + 1
+
+	// parameter type OIDs
+	if pos+2 > len(data) {
+		return name, query, nil, fmt.Errorf("truncated parse message (param count)")
+	}
+	nParams := int(binary.BigEndian.Uint16(data[pos:]))
+	pos += 2
+
+	if pos+nParams*4 > len(data) {
+		return name, query, nil, fmt.Errorf("truncated parse message (param types)")
+	}
+
+	oids := make([]uint32, nParams)
+	for i := range oids {
+		oids[i] = binary.BigEndian.Uint32(data[pos:])
+		pos += 4
+	}
+
+	return name, query, oids, nil
+}
@@ -1,56 +1,177 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
+
+	"thesis/sqlparser"
 )
 
-// initializePatterns sets up regex patterns for query classification
-func (p *Proxy) initializePatterns() {
-	writePatterns := []string{
-		`^\s*(INSERT|UPDATE|DELETE|CREATE|DROP|ALTER|TRUNCATE|GRANT|REVOKE)\s+`,
-		`^\s*(BEGIN|START\s+TRANSACTION|COMMIT|ROLLBACK)\s*`,
-		`^\s*(COPY\s+\w+\s+FROM)\s+`,
-		`^\s*(CALL|DO)\s+`,
-		`^\s*(LOCK|UNLOCK)\s+`,
-		`^\s*SET\s+((?!.*session_replication_role\s*=\s*replica).)*$`,
+// classifyQuery determines if a query is read or write operation. Reads that
+// lock rows or write through a CTE are writes, and so is a query holding
+// several statements unless each of them reads.
+func (p *Proxy) classifyQuery(query string) QueryClass {
+	_, query = parseHints(query)
+
+	if sqlparser.Classify(query) == sqlparser.Read {
+		return QueryRead
+	}
+
+	return QueryWrite // Default to write for safety
+}
+
+// parseQuery splits query into its statements for the checks a statement has
+// to pass, leaving out the routing hints at its head, which cannot make one
+// statement pass for another. What does not lex is a syntax error the backend
+// would refuse anyway, so rather than letting it through unchecked the proxy
+// refuses it first: the ErrorResponse to send the client is returned instead.
+func parseQuery(query string) ([]sqlparser.Statement, []byte) {
+	_, query = parseHints(query)
+
+	statements, err := sqlparser.Parse(query)
+	if err != nil {
+		return nil, encodeError("ERROR", "42601", fmt.Sprintf("syntax error: %v", err))
 	}
 
-	readPatterns := []string{
-		`^\s*(SELECT|WITH|EXPLAIN|ANALYZE)\s+`,
-		`^\s*(SHOW|DESCRIBE|DESC)\s+`,
-		`^\s*(COPY\s+\w+\s+TO)\s+`,
-		`^\s*SET\s+session_replication_role\s*=\s*replica`,
+	return statements, nil
+}
+
+// splitQuery turns what a client sent into the rows of the sqls table, one
+// for each statement in it. Hints at the head of a query string route all of
+// its statements and are recorded with each, and so is the firewall rule that
+// blocked one of them, with that one alone. A string the parser cannot split
+// is recorded as it is.
+func (p *Proxy) splitQuery(sql SQL) []SQL {
+	hints, query := parseHints(sql.Sql)
+	sql.Hint = formatHints(hints)
+
+	statements, err := sqlparser.Parse(query)
+	if err != nil || len(statements) == 0 {
+		class, _ := p.statementClass(sql.Sql)
+		sql.IsRead = class == QueryRead
+
+		return []SQL{sql}
 	}
 
-	for _, pattern := range writePatterns {
-		if regex, err := regexp.Compile("(?i)" + pattern); err == nil {
-			p.writePatterns = append(p.writePatterns, regex)
+	hintedClass, _, hinted := p.hintedClass(hints)
+	rows := make([]SQL, 0, len(statements))
+
+	for i, statement := range statements {
+		row := sql
+		row.Sql = statement.Text
+		row.Type = statement.Type
+		row.IsRead = statement.Class == sqlparser.Read
+
+		if hinted {
+			row.IsRead = hintedClass == QueryRead
+		}
+
+		tables := make([]string, 0, len(statement.Tables))
+		for _, table := range statement.Tables {
+			tables = append(tables, table.String())
+		}
+
+		row.Tables = strings.Join(tables, ",")
+
+		if i != sql.blocked {
+			row.RuleID = nil
 		}
+
+		rows = append(rows, row)
 	}
 
-	for _, pattern := range readPatterns {
-		if regex, err := regexp.Compile("(?i)" + pattern); err == nil {
-			p.readPatterns = append(p.readPatterns, regex)
+	return rows
+}
+
+var (
+	// SET name TO value as a statement of its own, replayed on other backends
+	setPattern = regexp.MustCompile(`(?is)^\s*SET\s+(SESSION\s+)?([a-z_][a-z0-9_$.]*|"(?:[^"]|"")+")\s*(=|\bTO\b)\s*(.+?)\s*;?\s*$`)
+
+	// SET TIME ZONE value, the same as SET timezone TO value
+	setTimeZonePattern = regexp.MustCompile(`(?is)^\s*SET\s+(SESSION\s+)?TIME\s+ZONE\s+('(?:[^']|'')*'|[a-z0-9_+-]+)\s*;?\s*$`)
+
+	// RESET name or RESET ALL as a statement of its own
+	resetPattern = regexp.MustCompile(`(?is)^\s*RESET\s+(TIME\s+ZONE|[a-z_][a-z0-9_$.]*|"(?:[^"]|"")+")\s*;?\s*$`)
+)
+
+// settingChange is a SET or RESET of a session parameter that a client ran.
+// The session replays its settings on every backend it borrows afterwards.
+type settingChange struct {
+	name  string // lower-cased parameter name, empty for RESET ALL
+	value string // value as SQL, empty to reset the parameter
+}
+
+// sessionState reports what a query does to the state of the backend session.
+// A SET or RESET alone in the query string is returned as a settingChange;
+// other statements that leave state behind, SET forms that cannot be
+// replayed among them, return pin. The statements are those the parser
+// splits the query into, so comments cannot hide one, and a query it cannot
+// split pins the session too.
+func (p *Proxy) sessionState(query string) (setting *settingChange, pin bool) {
+	statements, refused := parseQuery(query)
+	if refused != nil {
+		return nil, true
+	}
+
+	if len(statements) == 1 {
+		if setting := settingOf(statements[0].Text); setting != nil {
+			return setting, false
+		}
+	}
+
+	for _, statement := range statements {
+		if statement.SessionState {
+			return nil, true
 		}
 	}
+
+	return nil, false
 }
 
-// classifyQuery determines if a query is read or write operation
-func (p *Proxy) classifyQuery(query string) QueryClass {
-	trimmedQuery := strings.TrimSpace(query)
+// settingOf returns the change a SET or RESET statement makes to a session
+// parameter, or nil when it is not one the session can replay
+func settingOf(statement string) *settingChange {
+	if match := setPattern.FindStringSubmatch(statement); match != nil && !strings.Contains(match[4], ";") {
+		setting := &settingChange{name: parameterName(match[2]), value: match[4]}
+		if strings.EqualFold(setting.value, "DEFAULT") {
+			setting.value = ""
+		}
+
+		return setting
+	}
 
-	for _, regex := range p.readPatterns {
-		if regex.MatchString(trimmedQuery) {
-			return QueryRead
+	if match := setTimeZonePattern.FindStringSubmatch(statement); match != nil {
+		setting := &settingChange{name: "timezone", value: match[2]}
+		if strings.EqualFold(setting.value, "LOCAL") || strings.EqualFold(setting.value, "DEFAULT") {
+			setting.value = ""
 		}
+
+		return setting
 	}
 
-	for _, regex := range p.writePatterns {
-		if regex.MatchString(trimmedQuery) {
-			return QueryWrite
+	if match := resetPattern.FindStringSubmatch(statement); match != nil {
+		name := parameterName(match[1])
+
+		switch {
+		case name == "all":
+			name = ""
+		case len(strings.Fields(name)) == 2:
+			name = "timezone"
 		}
+
+		return &settingChange{name: name}
 	}
 
-	return QueryWrite // Default to write for safety
+	return nil
+}
+
+// parameterName folds a parameter name as PostgreSQL does: unquoted names are
+// lower-cased, quoted ones are taken as written
+func parameterName(name string) string {
+	if strings.HasPrefix(name, `"`) {
+		return strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+	}
+
+	return strings.ToLower(name)
 }
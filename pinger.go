@@ -1,32 +1,60 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
+
+	"thesis/store"
 )
 
+// replicationStatusQuery reports whether the server is a standby and how many
+// seconds its replay trails the primary. A standby that has replayed all the
+// WAL it received counts as caught up, even when the primary has been idle
+// since its last transaction.
+const replicationStatusQuery = `SELECT pg_is_in_recovery(),
+	CASE WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`
+
+// replicationStatus is what the health checker learns about an upstream's
+// replication
+type replicationStatus struct {
+	inRecovery bool
+	lag        time.Duration
+}
+
+// pingPostgres checks that an idle, authenticated backend session still
+// answers, by sending an empty query and reading up to its ReadyForQuery
 func pingPostgres(conn net.Conn) error {
 	// Set a timeout for the ping operation
 	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
 		return fmt.Errorf("failed to set deadline: %w", err)
 	}
 
-	// Simple query message to ping the database
-	// PostgreSQL wire protocol: 'Q' (Query) message followed by "SELECT 1;\0"
-	query := "Q\x00\x00\x00\x0fSELECT 1;\x00"
-
-	// Send the query
-	_, err := conn.Write([]byte(query))
-	if err != nil {
+	// An empty query is answered with EmptyQueryResponse and ReadyForQuery
+	if _, err := conn.Write(encodeSimpleQuery("")); err != nil {
 		return fmt.Errorf("failed to write ping query: %w", err)
 	}
 
-	// Read response to verify connection is working
-	buffer := make([]byte, 1024)
-	_, err = conn.Read(buffer)
-	if err != nil {
-		return fmt.Errorf("failed to read ping response: %w", err)
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return fmt.Errorf("failed to read ping response: %w", err)
+		}
+
+		if msg[0] == 'E' {
+			return fmt.Errorf("ping failed: %s", parseErrorOrNotice(msg[5:])["M"])
+		}
+
+		if msg[0] == 'Z' {
+			if len(msg) < 6 || msg[5] != 'I' {
+				return fmt.Errorf("idle session is not idle")
+			}
+
+			break
+		}
 	}
 
 	// Clear the deadline
@@ -36,3 +64,101 @@ func pingPostgres(conn net.Conn) error {
 
 	return nil
 }
+
+// checkReplication logs in to the upstream with the health check credential
+// and reads its replication status
+func checkReplication(up *Upstream, key PoolKey, credential *store.UpstreamCredential) (replicationStatus, error) {
+	var status replicationStatus
+
+	server, err := openServerConn(up.config, key, credential)
+	if err != nil {
+		return status, err
+	}
+
+	defer server.close()
+
+	row, err := queryRow(server.conn, replicationStatusQuery)
+	if err != nil {
+		return status, err
+	}
+
+	if len(row) != 2 {
+		return status, fmt.Errorf("replication status of %s has %d columns", up.Addr, len(row))
+	}
+
+	seconds, err := strconv.ParseFloat(row[1], 64)
+	if err != nil {
+		return status, fmt.Errorf("invalid replication lag %q from %s", row[1], up.Addr)
+	}
+
+	status.inRecovery = row[0] == "t"
+	status.lag = time.Duration(seconds * float64(time.Second))
+
+	return status, nil
+}
+
+// queryRow runs a simple query and returns the text of its first row's
+// columns, an empty string for NULL
+func queryRow(conn net.Conn, query string) ([]string, error) {
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, err
+	}
+
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(encodeSimpleQuery(query)); err != nil {
+		return nil, err
+	}
+
+	var (
+		row     []string
+		refused error
+	)
+
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg[0] {
+		case 'E':
+			refused = fmt.Errorf("query failed: %s", parseErrorOrNotice(msg[5:])["M"])
+		case 'D':
+			if row != nil || len(msg) < 7 {
+				continue
+			}
+
+			// DataRow: column count, then each value with its length
+			count, body := int(binary.BigEndian.Uint16(msg[5:7])), msg[7:]
+			row = make([]string, 0, count)
+
+			for range count {
+				if len(body) < 4 {
+					return nil, fmt.Errorf("truncated data row")
+				}
+
+				length := int(int32(binary.BigEndian.Uint32(body[:4])))
+				body = body[4:]
+
+				if length < 0 {
+					row = append(row, "")
+					continue
+				}
+
+				if length > len(body) {
+					return nil, fmt.Errorf("truncated data row")
+				}
+
+				row = append(row, string(body[:length]))
+				body = body[length:]
+			}
+		case 'Z':
+			if refused != nil {
+				return nil, refused
+			}
+
+			return row, nil
+		}
+	}
+}
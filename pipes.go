@@ -3,23 +3,42 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"net"
 	"strings"
-	"sync"
 	"time"
 )
 
-func (p *Proxy) frontend(serverConn net.Conn, request *Request, connID int, role UserRole, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (p *Proxy) frontend(session *Session) {
+	defer session.wg.Done()
+
+	// reset the backends for their pools once the client is gone
+	defer p.resetBackends(session)
 
 	var (
+		request           = session.request
+		connID            = int(request.connID)
 		preparedStatement string
+		statementName     string
+		unnamedStatement  string // query of the unnamed prepared statement
+		boundStatement    string // query of the statement the last Bind bound a portal to
+		paramTypes        []uint32
 		bindParameters    []string
 		reader            = bufio.NewReader(request.conn)
 		sqls              = make([]SQL, 0)
+
+		// extended-protocol messages are held back until Sync or Flush, then
+		// routed by the strongest class of the statements among them
+		batch      []byte
+		batchClass QueryClass
+		replies    []*pendingReply
+
+		refusal     []byte // ErrorResponse for a statement refused in the current group
+		refusalSent bool   // refusal was already written in answer to a Flush
+		flushed     bool   // part of the current group was already sent on Flush
 	)
 
 	defer func() {
@@ -29,10 +48,8 @@ func (p *Proxy) frontend(serverConn net.Conn, request *Request, connID int, role
 	}()
 
 	for {
-		// Read data from a client
-		data := make([]byte, 16384)
-		var sql SQL
-		n, err := reader.Read(data)
+		// Read one complete message from the client
+		data, err := readMessage(reader)
 		if err != nil {
 			if err != io.EOF {
 				p.logger.Error().Err(err).Msgf("FROM-CLIENT; [Conn %d] Error reading from client: %v", connID, err)
@@ -40,48 +57,58 @@ func (p *Proxy) frontend(serverConn net.Conn, request *Request, connID int, role
 			return
 		}
 
-		if n == 0 {
-			continue
-		}
-
-		data = data[:n]
+		sql := SQL{CreatedAt: time.Now()}
 
-		if data[0] == 'Q' && n > 5 { // here
-			query := string(bytes.Trim(data[5:], "\x00"))
+		switch data[0] {
+		case 'Q':
+			query := string(bytes.TrimRight(data[5:], "\x00"))
 			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Query: %s", connID, query)
 			sql.Sql = query
-		} else if data[0] == 'P' && n > 5 {
-			idx := bytes.IndexByte(data[5:], 0) + 5
-			if idx < n-1 {
-				query := string(bytes.Trim(data[idx+1:bytes.IndexByte(data[idx+1:], 0)+idx+1], "\x00"))
-				p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Parse: %s", connID, query)
-
-				preparedStatement = query
+		case 'P':
+			name, query, types, err := parseParseMessage(data)
+			if err != nil {
+				p.logger.Warn().Err(err).Msgf("FROM-CLIENT; [Conn %d] Client Parse: (malformed, %d bytes)", connID, len(data))
 			} else {
-				p.logger.Warn().Msgf("FROM-CLIENT; [Conn %d] Client Parse: (malformed, %d bytes)", connID, n)
+				p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Parse: %s", connID, query)
+				preparedStatement, statementName, paramTypes = query, name, types
 			}
-		} else if data[0] == 'B' && n > 5 {
-			params, _, err := parseBindParameters(data)
+		case 'B':
+			params, name, err := parseBindParameters(data)
+			statementName = name
 			if err != nil {
 				p.logger.Warn().Err(err).Msgf("FROM-CLIENT; [Conn %d] Client Bind: failed to parse parameters: %v", connID, err)
 			} else {
 				bindParameters = params
 				p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Bind Parameters: %v", connID, params)
 			}
-		} else if data[0] == 'p' {
+		case 'p':
 			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Password", connID)
-		} else if data[0] == 'D' && n > 5 {
+		case 'F':
+			if len(data) >= 9 {
+				p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client FunctionCall: function %d", connID, binary.BigEndian.Uint32(data[5:9]))
+			}
+		case 'D':
 			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Describe %v", connID, parseDescribeMessage(data))
-		} else if data[0] == 'E' && n == 5 {
-			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Close", connID)
-		} else if data[0] == 'S' && n == 5 {
+		case 'E':
+			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Execute", connID)
+		case 'C':
+			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Close %v", connID, parseDescribeMessage(data))
+		case 'S':
 			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Sync", connID)
-		} else if data[0] == 'X' && n == 5 {
+		case 'H':
+			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Flush", connID)
+		case 'X':
 			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client Terminate", connID)
-		} else {
+		default:
 			p.logger.Info().Msgf("FROM-CLIENT; [Conn %d] Client -> PostgreSQL: %x", connID, data)
 		}
 
+		// once a statement in an extended-protocol group is refused, the rest
+		// of the group is discarded up to its Sync, as PostgresSQL itself does
+		if refusal != nil && isExtendedQueryMessage(data[0]) {
+			continue
+		}
+
 		//TODO; REQUIRES MORE INDEPTH CHECKS
 		if len(bindParameters) > 0 {
 			// Naive substitution: replace $1, $2, ... with params
@@ -103,25 +130,160 @@ func (p *Proxy) frontend(serverConn net.Conn, request *Request, connID int, role
 			preparedStatement = ""
 		}
 
-		// IF THE LENGTH OF QUERY STRING IS MORE THAN 0 -> INSERT INTO DB AND CONTINUE
-		if len(sql.Sql) > 1 {
-			queryType := p.classifyQuery(sql.Sql)
+		var denied []byte
 
-			sql.IsRead = queryType == QueryRead
+		switch data[0] {
+		case 'Q', 'P':
+			query := sql.Sql
+			if data[0] == 'P' {
+				query = preparedStatement
+			}
 
-			if queryType == QueryWrite && role == UserRoleReadOnly {
-				p.logger.Info().Msgf("user doesn't have write access for SQL: %s", sql.Sql)
+			denied = p.authorizeQuery(session.role, query)
+			if denied == nil {
+				denied = p.firewallQuery(session, &sql, query)
+			}
 
-				//sql.
+			if denied == nil {
+				denied = p.allowlistQuery(session, query)
+			}
+		case 'F':
+			denied = p.authorizeFunctionCall(session, data)
+		}
 
-				// write error and quit
-				// quit
-				//STOP
+		if denied != nil {
+			if data[0] == 'P' {
+				sql.Sql = preparedStatement
+				preparedStatement = ""
 			}
+
+			sql.Rejected = true
+			p.logger.Warn().Msgf("FROM-CLIENT; [Conn %d] Rejected statement for role %s: %s", connID, session.role, sql.Sql)
+		}
+
+		switch data[0] {
+		case 'Q', 'F':
+			if denied != nil {
+				err = session.expect(&pendingReply{msgType: data[0], fake: denied, ready: true})
+				break
+			}
+
+			class := QueryWrite
+			reply := &pendingReply{msgType: data[0]}
+
+			if data[0] == 'Q' {
+				p.applyHints(session, sql.Sql)
+				class, session.upstreamHint = p.statementClass(sql.Sql)
+
+				if deallocateAllPattern.MatchString(sql.Sql) {
+					clear(session.statements)
+				}
+
+				// statements that leave state in the backend session run on
+				// the primary, which the session then keeps
+				setting, pin := p.sessionState(sql.Sql)
+				if pin {
+					session.pin()
+					class = QueryWrite
+				}
+
+				reply.setting = setting
+				reply.run = newStatementRun(sql.Sql)
+			}
+
+			err = p.route(session, class, data, reply)
+			session.upstreamHint = nil
+		case 'P', 'B', 'D', 'E', 'C':
+			if denied != nil {
+				refusal, batch, batchClass, replies = denied, nil, QueryUnknown, nil
+				break
+			}
+
+			switch data[0] {
+			case 'P':
+				if statementName != "" {
+					session.statements[statementName] = newPreparedStatement(preparedStatement, paramTypes)
+				} else {
+					unnamedStatement = preparedStatement
+				}
+
+				p.applyHints(session, preparedStatement)
+
+				class, upstream := p.statementClass(preparedStatement)
+				batchClass = max(batchClass, class)
+				session.upstreamHint = cmp.Or(upstream, session.upstreamHint)
+
+				// settings are only replayed from simple queries
+				if setting, pin := p.sessionState(preparedStatement); pin || setting != nil {
+					session.pin()
+					batchClass = QueryWrite
+				}
+			case 'B':
+				boundStatement = unnamedStatement
+
+				if statement, ok := session.statements[statementName]; ok {
+					class, upstream := p.statementClass(statement.query)
+					batchClass = max(batchClass, class)
+					session.upstreamHint = cmp.Or(upstream, session.upstreamHint)
+					boundStatement = statement.query
+				}
+			case 'C':
+				if len(data) > 6 && data[5] == 'S' {
+					name, _ := cString(data, 6)
+					delete(session.statements, name)
+				}
+			}
+
+			reply := &pendingReply{msgType: data[0]}
+			if data[0] == 'E' {
+				reply.run = newStatementRun(boundStatement)
+			}
+
+			batch = append(batch, data...)
+			replies = append(replies, reply)
+		case 'H':
+			if refusal == nil {
+				err = p.route(session, groupClass(batchClass, flushed), append(batch, data...), replies...)
+				flushed = true
+			} else if !refusalSent {
+				err = session.expect(&pendingReply{msgType: 'P', fake: refusal})
+				refusalSent = true
+			}
+
+			batch, replies = nil, nil
+		case 'S':
+			switch {
+			case refusal == nil:
+				err = p.route(session, groupClass(batchClass, flushed), append(batch, data...), append(replies, &pendingReply{msgType: 'S'})...)
+			case flushed:
+				// the backend holds the flushed part of the group open and
+				// still needs the Sync to close it
+				if !refusalSent {
+					err = session.expect(&pendingReply{msgType: 'P', fake: refusal})
+				}
+
+				if err == nil {
+					err = p.route(session, QueryUnknown, data, &pendingReply{msgType: 'S'})
+				}
+			default:
+				reply := &pendingReply{msgType: 'S', ready: true}
+				if !refusalSent {
+					reply.fake = refusal
+				}
+
+				err = session.expect(reply)
+			}
+
+			batch, batchClass, replies = nil, QueryUnknown, nil
+			refusal, refusalSent, flushed = nil, false, false
+			session.upstreamHint = nil
+		case 'X':
+			return
+		default:
+			// password and COPY data belong to whatever the current backend is doing
+			err = p.route(session, QueryUnknown, data)
 		}
 
-		// Forward data to PostgresSQL
-		_, err = serverConn.Write(data)
 		if err != nil {
 			p.logger.Error().Err(err).Msgf("FROM-CLIENT; [Conn %d] Error forwarding to PostgreSQL: %v", connID, err)
 			return
@@ -130,51 +292,92 @@ func (p *Proxy) frontend(serverConn net.Conn, request *Request, connID int, role
 		now := time.Now()
 		sql.CompletedAt = &now
 
+		// IF THE LENGTH OF QUERY STRING IS MORE THAN 0 -> INSERT INTO DB AND CONTINUE
 		if len(sql.Sql) > 1 {
-			sqls = append(sqls, sql)
+			sqls = append(sqls, p.splitQuery(sql)...)
 		}
 	}
 }
 
-func (p *Proxy) backend(serverConn, clientConn net.Conn, connID int, wg *sync.WaitGroup) {
-	defer wg.Done()
+// send writes data to a backend after queueing the replies the client is owed
+// for it, one for each message in data that the backend answers
+func (p *Proxy) send(backend *backendConn, session *Session, data []byte, replies ...*pendingReply) error {
+	data, err := session.expectFrom(backend, data, replies...)
+	if err != nil {
+		return err
+	}
+
+	_, err = backend.conn.Write(data)
+
+	return err
+}
+
+// groupClass is the class an extended-protocol group is routed by. Once part
+// of the group was flushed to a backend the rest has to follow it there.
+func groupClass(class QueryClass, flushed bool) QueryClass {
+	if flushed {
+		return QueryUnknown
+	}
+
+	return class
+}
+
+// isExtendedQueryMessage reports whether msgType belongs to the extended query
+// protocol and is discarded after an error until the next Sync
+func isExtendedQueryMessage(msgType byte) bool {
+	switch msgType {
+	case 'P', 'B', 'D', 'E', 'C':
+		return true
+	}
+
+	return false
+}
+
+func (p *Proxy) backend(session *Session, backend *backendConn) {
+	defer session.wg.Done()
 
 	var (
-		reader = bufio.NewReader(serverConn)
+		connID = int(session.request.connID)
+		reader = bufio.NewReader(backend.conn)
 	)
 
-	for {
-		// Read message type (1 byte)
-		msgType, err := reader.ReadByte()
-		if err != nil {
-			if err != io.EOF {
-				p.logger.Error().Err(err).Msgf("FROM-POSTGRES; [Conn %d] Error reading message type from PostgreSQL: %v", connID, err)
-			}
-			return
-		}
+	// hand the connection back to its pool once nothing reads from it anymore
+	defer func() {
+		session.lock.Lock()
 
-		// Read length (int32, includes length bytes but not the type byte)
-		lengthBytes := make([]byte, 4)
-		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
-			p.logger.Error().Err(err).Msgf("FROM-POSTGRES; [Conn %d] Error reading message length from PostgreSQL: %v", connID, err)
-			return
+		// bytes already read past the reset belong to nobody
+		if reader.Buffered() > 0 {
+			backend.reusable = false
 		}
 
-		msgLength := int(binary.BigEndian.Uint32(lengthBytes))
-		if msgLength < 4 {
-			p.logger.Error().Msgf("FROM-POSTGRES; [Conn %d] Invalid message length: %d", connID, msgLength)
+		backend.done = true
+		reusable := backend.reusable
+		session.cond.Broadcast()
+
+		session.lock.Unlock()
+
+		if !reusable || backend.conn.SetDeadline(time.Time{}) != nil {
+			backend.pool.Discard(backend.server)
 			return
 		}
 
-		// Read the rest of the message body
-		body := make([]byte, msgLength-4)
-		if _, err := io.ReadFull(reader, body); err != nil {
-			p.logger.Error().Err(err).Msgf("FROM-POSTGRES; [Conn %d] Error reading message body from PostgreSQL: %v", connID, err)
+		backend.pool.Release(backend.server)
+	}()
+
+	for {
+		// Read one complete message from PostgresSQL
+		fullMsg, err := readMessage(reader)
+		if err != nil {
+			if err != io.EOF {
+				p.logger.Error().Err(err).Msgf("FROM-POSTGRES; [Conn %d] Error reading message from PostgreSQL: %v", connID, err)
+			}
+
+			// a backend that went away ends the whole client session
+			session.end()
 			return
 		}
 
-		// Reconstruct the full message to forward to the client
-		fullMsg := append([]byte{msgType}, append(lengthBytes, body...)...)
+		msgType, body := fullMsg[0], fullMsg[5:]
 
 		// Log based on message type
 		switch msgType {
@@ -232,8 +435,13 @@ func (p *Proxy) backend(serverConn, clientConn net.Conn, connID int, wg *sync.Wa
 		}
 
 		// Forward the message to the client
-		if _, err = clientConn.Write(fullMsg); err != nil {
+		if err = session.forward(backend, fullMsg); err != nil {
+			if errors.Is(err, errBackendReleased) {
+				return
+			}
+
 			p.logger.Error().Err(err).Msgf("FROM-POSTGRES; [Conn %d] Error forwarding to client: %v", connID, err)
+			session.end()
 			return
 		}
 	}
@@ -2,116 +2,712 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"maps"
 	"net"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"thesis/store"
+)
+
+// protocolVersion3 is the protocol version the pool opens backend sessions with
+const protocolVersion3 = 196608
+
+// Pool modes of a listener. In session mode a client keeps its backend
+// sessions until it disconnects; in transaction mode it borrows one for each
+// transaction or standalone statement and hands it back at ReadyForQuery.
+const (
+	PoolModeSession     = "session"
+	PoolModeTransaction = "transaction"
+)
+
+const (
+	// idleCheckAfter is how long a session may sit idle before it is pinged
+	// again ahead of being handed out
+	idleCheckAfter = 10 * time.Second
+
+	// reapInterval is how often expired sessions are closed and the pools
+	// are topped up to MinIdle
+	reapInterval = 5 * time.Second
 )
 
 type PoolConfig struct {
 	MaxConnections int           // Maximum number of connections in the pool
+	MinIdle        int           // Idle connections kept open for each key the pool has served
 	ConnString     string        // PostgreSQL connection string
+	TLSConfig      *tls.Config   // TLS settings for the server, nil to connect in plaintext
 	MaxIdleTime    time.Duration // Max time a connection can remain idle
 	MaxLifetime    time.Duration // Max lifetime of a connection
+	MaxWait        time.Duration // Max time a caller waits for a connection when the pool is full, 0 for no limit
+	MaxWaiters     int           // Max callers waiting at once, 0 for no limit
+}
+
+// PoolKey identifies interchangeable backend sessions: the same database
+// opened by the same database user
+type PoolKey struct {
+	User     string
+	Database string
+}
+
+// ServerConn is an authenticated backend session owned by a pool
+type ServerConn struct {
+	conn      net.Conn
+	key       PoolKey
+	params    map[string]string // ParameterStatus values reported by the server
+	settings  map[string]string // client settings applied with SET since the last reset
+	prepared  map[string]bool   // statements prepared under their server names
+	cancelKey *cancelKey        // the server's BackendKeyData
+	createdAt time.Time
+	lastUsed  time.Time
+}
+
+// poolExhaustedError is returned when a caller gives up on a full pool, because
+// no connection freed up within MaxWait or too many callers were waiting already
+type poolExhaustedError struct {
+	reason string
+}
+
+func (e *poolExhaustedError) Error() string {
+	return e.reason
+}
+
+// poolWaiter is a caller queued for a session of key. It is handed either a
+// released session of that key or nil, a free slot to open one in.
+type poolWaiter struct {
+	key   PoolKey
+	ready chan *ServerConn // closed when the pool closes
 }
 
+// PoolStats is a snapshot of a pool's sessions and of the callers that had
+// to wait for one
+type PoolStats struct {
+	MaxConnections int     `json:"max_connections"`
+	Open           int     `json:"open"`
+	Idle           int     `json:"idle"`
+	Waiting        int     `json:"waiting"`
+	WaitCount      uint64  `json:"wait_count"`
+	AvgWaitTimeMs  float64 `json:"avg_wait_time_ms"`
+	MaxWaitTimeMs  float64 `json:"max_wait_time_ms"`
+	Exhausted      uint64  `json:"exhausted"`
+}
+
+// ConnectionPool holds the authenticated backend sessions of one upstream,
+// grouped by PoolKey. Sessions are opened on demand, up to MaxConnections in
+// total, and reset with DISCARD ALL before they are handed out again. Idle
+// sessions past MaxIdleTime and sessions past MaxLifetime are closed. Callers
+// that find the pool full wait their turn in a queue.
 type ConnectionPool struct {
 	config      PoolConfig
-	connections chan net.Conn
 	mutex       sync.Mutex
+	idle        map[PoolKey][]*ServerConn             // most recently released last
+	credentials map[PoolKey]*store.UpstreamCredential // login each key was last opened with, for MinIdle
+	slots       chan struct{}                         // one token per open session, idle or in use
+	waiters     []*poolWaiter                         // callers blocked on a free slot, oldest first
 	closed      bool
+
+	// waits so far, for PoolStats
+	waitCount   uint64
+	waitTime    time.Duration
+	maxWaitTime time.Duration
+	exhausted   uint64
 }
 
 func NewConnectionPool(config PoolConfig) (*ConnectionPool, error) {
-	pool := &ConnectionPool{
+	if config.MaxConnections <= 0 {
+		return nil, fmt.Errorf("invalid pool size %d", config.MaxConnections)
+	}
+
+	return &ConnectionPool{
 		config:      config,
-		connections: make(chan net.Conn, config.MaxConnections),
-		closed:      false,
+		idle:        make(map[PoolKey][]*ServerConn),
+		credentials: make(map[PoolKey]*store.UpstreamCredential),
+		slots:       make(chan struct{}, config.MaxConnections),
+	}, nil
+}
+
+func (p *ConnectionPool) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
 	}
 
-	// Initialize the pool with connections
-	for i := 0; i < config.MaxConnections; i++ {
-		conn, err := net.Dial("tcp", config.ConnString)
-		if err != nil {
-			// Close any already opened connections
-			pool.Close()
-			return nil, fmt.Errorf("failed to create connection: %w", err)
-		}
+	p.closed = true
+	idle := p.idle
+	p.idle = make(map[PoolKey][]*ServerConn)
 
-		pool.connections <- conn
+	for _, waiter := range p.waiters {
+		close(waiter.ready)
 	}
 
-	return pool, nil
+	p.waiters = nil
+	p.mutex.Unlock()
+
+	p.discard(idle)
 }
 
-func (p *ConnectionPool) Close() {
+// DiscardIdle terminates the idle sessions, as when the upstream went down
+// and took them with it. Sessions in use are left to their borrowers.
+func (p *ConnectionPool) DiscardIdle() {
 	p.mutex.Lock()
-	if p.closed {
+	idle := p.idle
+	p.idle = make(map[PoolKey][]*ServerConn)
+	p.mutex.Unlock()
+
+	p.discard(idle)
+}
+
+func (p *ConnectionPool) discard(idle map[PoolKey][]*ServerConn) {
+	for _, servers := range idle {
+		for _, server := range servers {
+			p.Discard(server)
+		}
+	}
+}
+
+// Release returns a session to the pool. The caller must already have reset
+// it with DISCARD ALL.
+func (p *ConnectionPool) Release(server *ServerConn) {
+	p.mutex.Lock()
+
+	server.lastUsed = time.Now()
+
+	if p.closed || p.expired(server) {
 		p.mutex.Unlock()
+		p.Discard(server)
 		return
 	}
 
-	p.closed = true
+	// the oldest waiter takes the session if it wants one of this key, and
+	// otherwise gets the slot rather than the session going idle
+	if len(p.waiters) > 0 {
+		if waiter := p.waiters[0]; waiter.key == server.key {
+			p.waiters = p.waiters[1:]
+			waiter.ready <- server
+			p.mutex.Unlock()
+			return
+		}
+
+		p.mutex.Unlock()
+		p.Discard(server)
+		return
+	}
+
+	p.idle[server.key] = append(p.idle[server.key], server)
+
 	p.mutex.Unlock()
+}
 
-	close(p.connections)
+// Discard terminates a session that cannot be reused and frees its slot
+func (p *ConnectionPool) Discard(server *ServerConn) {
+	server.close()
+	p.freeSlot()
+}
 
-	for conn := range p.connections {
-		_ = conn.Close()
+// releaseFailed returns a session that setParams failed on. A server that
+// refused the settings is still in step with the protocol and goes back once
+// DISCARD ALL has reset it; after any other failure it is discarded.
+func (p *ConnectionPool) releaseFailed(server *ServerConn, err error) {
+	var refused *backendError
+	if !errors.As(err, &refused) || server.reset() != nil {
+		p.Discard(server)
+		return
 	}
+
+	p.Release(server)
 }
 
-// Release returns a connection to the pool.
-func (p *ConnectionPool) Release(conn net.Conn) {
+// freeSlot gives up a slot, handing it to the oldest waiter if there is one
+func (p *ConnectionPool) freeSlot() {
 	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.waiters) > 0 {
+		waiter := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		waiter.ready <- nil
+
+		return
+	}
+
+	<-p.slots
+}
+
+// Get returns an authenticated session for key, reusing an idle one when
+// possible and otherwise opening a new one with credential.
+func (p *ConnectionPool) Get(ctx context.Context, key PoolKey, credential *store.UpstreamCredential) (*ServerConn, error) {
+	for {
+		server, err := p.takeIdle(key, credential)
+		if err != nil {
+			return nil, err
+		}
+
+		if server == nil {
+			break
+		}
+
+		// a session that sat idle for a while may have been dropped by the server
+		if time.Since(server.lastUsed) > idleCheckAfter {
+			if err = pingPostgres(server.conn); err != nil {
+				p.Discard(server)
+				continue
+			}
+		}
+
+		return server, nil
+	}
+
+	server, err := p.acquireSlot(ctx, key)
+	if err != nil || server != nil {
+		return server, err
+	}
+
+	if server, err = p.open(key, credential); err != nil {
+		p.freeSlot()
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// takeIdle pops the most recently used idle session for key, discarding the
+// ones that outlived MaxIdleTime or MaxLifetime. It also remembers credential
+// as the login to open key's MinIdle sessions with.
+func (p *ConnectionPool) takeIdle(key PoolKey, credential *store.UpstreamCredential) (*ServerConn, error) {
+	var expired []*ServerConn
+
+	defer func() {
+		for _, server := range expired {
+			p.Discard(server)
+		}
+	}()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
 	if p.closed {
-		p.mutex.Unlock()
-		_ = conn.Close()
+		return nil, fmt.Errorf("connection pool is closed")
+	}
+
+	p.credentials[key] = credential
+
+	for servers := p.idle[key]; len(servers) > 0; servers = p.idle[key] {
+		server := servers[len(servers)-1]
+		p.idle[key] = servers[:len(servers)-1]
+
+		if p.expired(server) {
+			expired = append(expired, server)
+			continue
+		}
+
+		return server, nil
+	}
+
+	return nil, nil
+}
+
+// Reap closes the idle sessions that outlived MaxIdleTime or MaxLifetime,
+// then opens sessions until every key the pool has served has MinIdle idle
+// ones, as far as free slots allow
+func (p *ConnectionPool) Reap() {
+	p.mutex.Lock()
+
+	var expired []*ServerConn
+
+	for key, servers := range p.idle {
+		kept := servers[:0]
+
+		for _, server := range servers {
+			if p.expired(server) {
+				expired = append(expired, server)
+			} else {
+				kept = append(kept, server)
+			}
+		}
+
+		p.idle[key] = kept
+	}
+
+	p.mutex.Unlock()
+
+	for _, server := range expired {
+		p.Discard(server)
+	}
+
+	p.fillIdle()
+}
+
+// fillIdle opens sessions for the keys short of MinIdle idle ones. It never
+// waits for a slot, and leaves the free ones to callers that are waiting.
+func (p *ConnectionPool) fillIdle() {
+	if p.config.MinIdle <= 0 {
 		return
 	}
 
+	p.mutex.Lock()
+
+	short := make(map[PoolKey]int)
+	for key := range p.credentials {
+		if missing := p.config.MinIdle - len(p.idle[key]); missing > 0 {
+			short[key] = missing
+		}
+	}
+
 	p.mutex.Unlock()
 
-	select {
-	case p.connections <- conn:
-		// Connection returned to pool
-	default:
-		// Pool is full, close the connection
-		_ = conn.Close()
+	for key, missing := range short {
+		for ; missing > 0; missing-- {
+			p.mutex.Lock()
+
+			if p.closed || len(p.waiters) > 0 || !p.trySlot() {
+				p.mutex.Unlock()
+				return
+			}
+
+			credential := p.credentials[key]
+			p.mutex.Unlock()
+
+			server, err := p.open(key, credential)
+			if err != nil {
+				p.freeSlot()
+				break
+			}
+
+			p.Release(server)
+		}
 	}
 }
 
-// Get retrieves a connection from the pool.
-func (p *ConnectionPool) Get(ctx context.Context) (net.Conn, error) {
+func (p *ConnectionPool) expired(server *ServerConn) bool {
+	now := time.Now()
+
+	return (p.config.MaxLifetime > 0 && now.Sub(server.createdAt) > p.config.MaxLifetime) ||
+		(p.config.MaxIdleTime > 0 && now.Sub(server.lastUsed) > p.config.MaxIdleTime)
+}
+
+// acquireSlot reserves room for a new session. When the pool is full an idle
+// session of another key is closed to make room; otherwise the caller joins
+// the queue and waits up to MaxWait. A waiter may be handed a released
+// session of its key instead, which is returned.
+func (p *ConnectionPool) acquireSlot(ctx context.Context, key PoolKey) (*ServerConn, error) {
 	p.mutex.Lock()
+
 	if p.closed {
 		p.mutex.Unlock()
 		return nil, fmt.Errorf("connection pool is closed")
 	}
 
+	// callers already waiting go first
+	if len(p.waiters) == 0 {
+		if p.trySlot() {
+			p.mutex.Unlock()
+			return nil, nil
+		}
+
+		if victim := p.evictIdle(key); victim != nil {
+			p.mutex.Unlock()
+
+			// the slot changes hands instead of being freed
+			victim.close()
+
+			return nil, nil
+		}
+	}
+
+	if p.config.MaxWaiters > 0 && len(p.waiters) >= p.config.MaxWaiters {
+		p.exhausted++
+		p.mutex.Unlock()
+
+		return nil, &poolExhaustedError{reason: "too many clients waiting for a backend connection"}
+	}
+
+	waiter := &poolWaiter{key: key, ready: make(chan *ServerConn, 1)}
+	p.waiters = append(p.waiters, waiter)
 	p.mutex.Unlock()
 
+	start := time.Now()
+
+	var timeout <-chan time.Time
+	if p.config.MaxWait > 0 {
+		timer := time.NewTimer(p.config.MaxWait)
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	var err error
+
 	select {
-	// ping or reconnect to the database
-	case conn := <-p.connections:
-		// Check if the connection is still valid
-		if err := pingPostgres(conn); err != nil {
-			// Close an invalid connection and create a new one
-			_ = conn.Close()
-
-			// reconnect to the database
-			newConn, err := net.Dial("tcp", p.config.ConnString)
-			if err != nil {
-				return nil, fmt.Errorf("failed to replace invalid connection: %w", err)
+	case server, ok := <-waiter.ready:
+		p.recordWait(time.Since(start))
+
+		if !ok {
+			return nil, fmt.Errorf("connection pool is closed")
+		}
+
+		return server, nil
+	case <-timeout:
+		err = &poolExhaustedError{reason: fmt.Sprintf("no backend connection became available within %s", p.config.MaxWait)}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.mutex.Lock()
+
+	if i := slices.Index(p.waiters, waiter); i >= 0 {
+		p.waiters = slices.Delete(p.waiters, i, i+1)
+		p.exhausted++
+		p.mutex.Unlock()
+
+		p.recordWait(time.Since(start))
+
+		return nil, err
+	}
+
+	p.mutex.Unlock()
+
+	// the slot or session was handed over just as the caller gave up
+	p.recordWait(time.Since(start))
+
+	server, ok := <-waiter.ready
+	if !ok {
+		return nil, fmt.Errorf("connection pool is closed")
+	}
+
+	return server, nil
+}
+
+// trySlot reserves a slot if one is free. The caller must hold p.mutex.
+func (p *ConnectionPool) trySlot() bool {
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordWait counts a caller that waited in the queue for d
+func (p *ConnectionPool) recordWait(d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.waitCount++
+	p.waitTime += d
+	p.maxWaitTime = max(p.maxWaitTime, d)
+}
+
+// Stats returns a snapshot of the pool's sessions and waiters
+func (p *ConnectionPool) Stats() PoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	idle := 0
+	for _, servers := range p.idle {
+		idle += len(servers)
+	}
+
+	stats := PoolStats{
+		MaxConnections: p.config.MaxConnections,
+		Open:           len(p.slots),
+		Idle:           idle,
+		Waiting:        len(p.waiters),
+		WaitCount:      p.waitCount,
+		MaxWaitTimeMs:  float64(p.maxWaitTime) / float64(time.Millisecond),
+		Exhausted:      p.exhausted,
+	}
+
+	if p.waitCount > 0 {
+		stats.AvgWaitTimeMs = float64(p.waitTime) / float64(p.waitCount) / float64(time.Millisecond)
+	}
+
+	return stats
+}
+
+// evictIdle takes the least recently used idle session of a key other than
+// key out of the pool, handing its slot to the caller, and returns it for the
+// caller to close once it released p.mutex, or nil when there is none. The
+// caller must hold p.mutex.
+func (p *ConnectionPool) evictIdle(key PoolKey) *ServerConn {
+	var (
+		victim    *ServerConn
+		victimKey PoolKey
+	)
+
+	for k, servers := range p.idle {
+		if k == key || len(servers) == 0 {
+			continue
+		}
+
+		if victim == nil || servers[0].lastUsed.Before(victim.lastUsed) {
+			victim, victimKey = servers[0], k
+		}
+	}
+
+	if victim != nil {
+		p.idle[victimKey] = p.idle[victimKey][1:]
+	}
+
+	return victim
+}
+
+// open dials the upstream and runs the startup handshake for key
+func (p *ConnectionPool) open(key PoolKey, credential *store.UpstreamCredential) (*ServerConn, error) {
+	return openServerConn(p.config, key, credential)
+}
+
+// openServerConn dials the upstream of config and logs in as key's user
+func openServerConn(config PoolConfig, key PoolKey, credential *store.UpstreamCredential) (*ServerConn, error) {
+	conn, err := dialUpstream(config.ConnString, config.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connection: %w", err)
+	}
+
+	startup := buildStartupMessage(map[string]string{"user": key.User, "database": key.Database}, protocolVersion3)
+
+	if _, err = conn.Write(startup); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to send startup message to %s: %w", config.ConnString, err)
+	}
+
+	if err = authenticateBackend(conn, config.ConnString, credential); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	server := &ServerConn{
+		conn:      conn,
+		key:       key,
+		params:    make(map[string]string),
+		prepared:  make(map[string]bool),
+		createdAt: time.Now(),
+		lastUsed:  time.Now(),
+	}
+
+	// ParameterStatus and BackendKeyData follow AuthenticationOk, up to the
+	// first ReadyForQuery
+	if err = server.readUntilReady(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// close asks the server to end the session and closes the connection
+func (s *ServerConn) close() {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(time.Second)); err == nil {
+		_, _ = s.conn.Write([]byte{'X', 0, 0, 0, 4})
+	}
+
+	_ = s.conn.Close()
+}
+
+// setParams applies a client's settings, parameter names mapped to SQL
+// values, to the session with SET, which DISCARD ALL undoes when the session
+// is released. Nothing is sent when the session already carries exactly these
+// settings, and ones applied for a previous client are first undone with
+// RESET ALL.
+func (s *ServerConn) setParams(params map[string]string) error {
+	query, ok := settingsQuery(s.settings, params)
+	if !ok {
+		return nil
+	}
+
+	if _, err := s.conn.Write(encodeSimpleQuery(query)); err != nil {
+		return err
+	}
+
+	if err := s.readUntilReady(); err != nil {
+		return err
+	}
+
+	s.settings = params
+
+	return nil
+}
+
+// settingsQuery returns the statements that take a session carrying current
+// to params, and false when it already carries exactly these
+func settingsQuery(current, params map[string]string) (string, bool) {
+	if maps.Equal(current, params) {
+		return "", false
+	}
+
+	statements := make([]string, 0, len(params))
+	for name, value := range params {
+		statements = append(statements, fmt.Sprintf("SET %s TO %s", quoteIdentifier(name), value))
+	}
+
+	// sorted so that equal settings always produce the same query
+	sort.Strings(statements)
+
+	if len(current) > 0 {
+		statements = append([]string{"RESET ALL"}, statements...)
+	}
+
+	return strings.Join(statements, "; "), true
+}
+
+// reset undoes everything the session's clients set up with DISCARD ALL
+func (s *ServerConn) reset() error {
+	if _, err := s.conn.Write(encodeSimpleQuery("DISCARD ALL")); err != nil {
+		return err
+	}
+
+	if err := s.readUntilReady(); err != nil {
+		return err
+	}
+
+	s.settings = nil
+
+	return nil
+}
+
+// readUntilReady reads the server's messages up to ReadyForQuery, recording
+// parameter changes and the backend key. An ErrorResponse is returned as a
+// *backendError once ReadyForQuery or the end of the connection is reached.
+func (s *ServerConn) readUntilReady() error {
+	if err := s.conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+
+	var refused error
+
+	for {
+		msg, err := readMessage(s.conn)
+		if err != nil {
+			if refused != nil {
+				return refused
 			}
 
-			return newConn, nil
+			return fmt.Errorf("failed to read from %s: %w", s.conn.RemoteAddr(), err)
 		}
 
-		return conn, nil
+		switch msg[0] {
+		case 'S':
+			if keyValue := parseParameterStatus(msg[5:]); len(keyValue) >= 2 {
+				s.params[keyValue[0]] = keyValue[1]
+			}
+		case 'K':
+			if len(msg) >= 13 {
+				key := parseCancelKey(msg[5:13])
+				s.cancelKey = &key
+			}
+		case 'E':
+			refused = &backendError{addr: s.conn.RemoteAddr().String(), msg: msg}
+		case 'Z':
+			if err = s.conn.SetReadDeadline(time.Time{}); err != nil {
+				return err
+			}
 
-	case <-ctx.Done():
-		return nil, ctx.Err()
+			return refused
+		}
 	}
 }
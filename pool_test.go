@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// waitFor queues a caller for a session of key and returns where its result arrives
+func waitFor(t *testing.T, pool *ConnectionPool, key PoolKey) <-chan *ServerConn {
+	t.Helper()
+
+	waiting := pool.Stats().Waiting
+	result := make(chan *ServerConn, 1)
+
+	go func() {
+		server, err := pool.acquireSlot(context.Background(), key)
+		if err != nil {
+			t.Errorf("acquireSlot(%v): %v", key, err)
+		}
+
+		result <- server
+	}()
+
+	// the next caller must queue behind this one
+	for deadline := time.Now().Add(time.Second); pool.Stats().Waiting == waiting; {
+		if time.Now().After(deadline) {
+			t.Fatalf("caller for %v never queued", key)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return result
+}
+
+func testServer(t *testing.T, key PoolKey) *ServerConn {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	// swallow the Terminate a discarded session sends
+	go func() {
+		_, _ = readMessage(server)
+	}()
+
+	return &ServerConn{conn: client, key: key, params: make(map[string]string), createdAt: time.Now()}
+}
+
+func received(t *testing.T, result <-chan *ServerConn) *ServerConn {
+	t.Helper()
+
+	select {
+	case server := <-result:
+		return server
+	case <-time.After(time.Second):
+		t.Fatal("waiter was never served")
+		return nil
+	}
+}
+
+func TestPoolWaitersFIFO(t *testing.T) {
+	pool, _ := NewConnectionPool(PoolConfig{MaxConnections: 1})
+	alice, bob := PoolKey{User: "alice", Database: "d"}, PoolKey{User: "bob", Database: "d"}
+
+	if server, err := pool.acquireSlot(context.Background(), alice); server != nil || err != nil {
+		t.Fatalf("first acquireSlot = %v, %v, want a free slot", server, err)
+	}
+
+	first := waitFor(t, pool, alice)
+	second := waitFor(t, pool, bob)
+	third := waitFor(t, pool, alice)
+
+	// the oldest waiter takes the released session of its key
+	released := testServer(t, alice)
+	pool.Release(released)
+
+	if server := received(t, first); server != released {
+		t.Errorf("first waiter got %v, want the released session", server)
+	}
+
+	// the next one wants another key, so the session is closed for its slot
+	pool.Release(testServer(t, alice))
+
+	if server := received(t, second); server != nil {
+		t.Errorf("second waiter got %v, want a free slot", server)
+	}
+
+	pool.freeSlot()
+
+	if server := received(t, third); server != nil {
+		t.Errorf("third waiter got %v, want a free slot", server)
+	}
+
+	if stats := pool.Stats(); stats.Waiting != 0 || stats.WaitCount != 3 || stats.Idle != 0 {
+		t.Errorf("stats = %+v, want 3 waits and nobody waiting", stats)
+	}
+}
+
+func TestPoolMaxWaiters(t *testing.T) {
+	pool, _ := NewConnectionPool(PoolConfig{MaxConnections: 1, MaxWaiters: 1})
+	key := PoolKey{User: "alice", Database: "d"}
+
+	_, _ = pool.acquireSlot(context.Background(), key)
+	waiter := waitFor(t, pool, key)
+
+	_, err := pool.acquireSlot(context.Background(), key)
+
+	var exhausted *poolExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("acquireSlot past MaxWaiters = %v, want a poolExhaustedError", err)
+	}
+
+	pool.freeSlot()
+	received(t, waiter)
+
+	if stats := pool.Stats(); stats.Exhausted != 1 {
+		t.Errorf("exhausted = %d, want 1", stats.Exhausted)
+	}
+}
+
+func TestPoolMaxWait(t *testing.T) {
+	pool, _ := NewConnectionPool(PoolConfig{MaxConnections: 1, MaxWait: 20 * time.Millisecond})
+	key := PoolKey{User: "alice", Database: "d"}
+
+	_, _ = pool.acquireSlot(context.Background(), key)
+
+	_, err := pool.acquireSlot(context.Background(), key)
+
+	var exhausted *poolExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("acquireSlot past MaxWait = %v, want a poolExhaustedError", err)
+	}
+
+	if stats := pool.Stats(); stats.Waiting != 0 || stats.Exhausted != 1 {
+		t.Errorf("stats = %+v, want the waiter gone and counted as exhausted", stats)
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
-	"regexp"
 	"sync"
 	"time"
 
@@ -18,20 +18,26 @@ import (
 
 // Proxy represents the PostgresSQL proxy
 type Proxy struct {
-	writePatterns []*regexp.Regexp
-	readPatterns  []*regexp.Regexp
-	config        *Config
-	connCounter   uint64 // Atomic counter for connection IDs
-	lock          sync.Mutex
-	next          int
-	logger        *zerolog.Logger
-	sqliteDB      *sql.DB
-	ctx           context.Context
-	cancel        context.CancelFunc
-	pingInterval  time.Duration
-	servers       []*Upstream
-	unhealthy     []*Upstream
-	serverIndex   uint64
+	config       *Config
+	connCounter  uint64 // Atomic counter for connection IDs
+	lock         sync.Mutex
+	next         int
+	logger       *zerolog.Logger
+	sqliteDB     *sql.DB
+	ctx          context.Context
+	cancel       context.CancelFunc
+	pingInterval time.Duration
+	primary      *Upstream
+	servers      []*Upstream
+	unhealthy    []*Upstream
+	balancers    map[string]Balancer // picks the replica a session's reads go to, by replica group
+	tlsConfig    *tls.Config         // nil when client TLS is not configured
+	sessions     map[cancelKey]*Session
+	sessionsLock sync.Mutex
+	stats        proxyStats
+	firewall     firewall
+	allowlist    allowlist
+	queryStats   queryStats
 
 	store struct {
 		healthCheckStore store.HealthCheckInterface
@@ -39,6 +45,9 @@ type Proxy struct {
 		requestStore     store.RequestInterface
 		logsStore        store.LogsInterface
 		sqlStore         store.SQLInterface
+		credentialStore  store.UpstreamCredentialInterface
+		firewallStore    store.FirewallRuleInterface
+		allowlistStore   store.AllowlistInterface
 	}
 }
 
@@ -46,39 +55,64 @@ type Proxy struct {
 func NewProxy(config *Config, db *sql.DB, logger zerolog.Logger) *Proxy {
 	servers, unhealthy := make([]*Upstream, 0), make([]*Upstream, 0)
 
-	for _, v := range config.servers {
-		poolConf := PoolConfig{
+	newPoolConfig := func(upstream UpstreamConfig) PoolConfig {
+		tlsConfig, err := newUpstreamTLSConfig(upstream)
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("Invalid TLS configuration for upstream %s", upstream.addr)
+		}
+
+		return PoolConfig{
 			MaxConnections: config.connectionPoolSize,
-			ConnString:     v,
-			MaxIdleTime:    30 * time.Second,
-			MaxLifetime:    1 * time.Hour,
+			MinIdle:        config.poolMinIdle,
+			ConnString:     upstream.addr,
+			TLSConfig:      tlsConfig,
+			MaxIdleTime:    config.poolMaxIdleTime,
+			MaxLifetime:    config.poolMaxLifetime,
+			MaxWait:        config.poolMaxWait,
+			MaxWaiters:     config.poolMaxWaiters,
 		}
+	}
 
-		pool, err := NewConnectionPool(poolConf)
-		if err != nil {
-			logger.Error().Err(err).Msgf("Failed to connect to replica %v: %v", v, err)
+	primary := newUpstream(config.primary, UpstreamPrimary, newPoolConfig(config.primary), logger)
 
-			unhealthy = append(unhealthy, &Upstream{
-				Addr:    v,
-				Healthy: false,
-				Lag:     0,
-				lock:    sync.Mutex{},
-				ID:      uuid.New(),
-				pool:    nil,
-			})
+	for _, v := range config.servers {
+		replica := newUpstream(v, UpstreamReplica, newPoolConfig(v), logger)
 
+		if !replica.Healthy {
+			unhealthy = append(unhealthy, replica)
 			continue
 		}
 
-		servers = append(servers, &Upstream{
-			Addr:    v,
-			Healthy: true,
-			Lag:     0,
-			lock:    sync.Mutex{},
-			ID:      uuid.New(),
-			pool:    pool,
-			config:  poolConf,
-		})
+		servers = append(servers, replica)
+	}
+
+	tlsConfig, err := newServerTLSConfig(config)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load TLS configuration")
+	}
+
+	balancers := make(map[string]Balancer, len(config.replicaBalancers))
+	for group, balancerConfig := range config.replicaBalancers {
+		if balancers[group], err = newBalancer(balancerConfig); err != nil {
+			logger.Fatal().Err(err).Msgf("Invalid %s", balancerVariable(group))
+		}
+	}
+
+	if !validConsistency(config.consistency) {
+		logger.Fatal().Msgf("Invalid CONSISTENCY %q", config.consistency)
+	}
+
+	if !validAllowlistMode(config.allowlistMode) {
+		logger.Fatal().Msgf("Invalid ALLOWLIST_MODE %q", config.allowlistMode)
+	}
+
+	// replication lag is measured by the health checker, which has to log in
+	if config.replicaMaxLag > 0 {
+		if config.healthCheckUser == "" {
+			logger.Warn().Msg("REPLICA_MAX_LAG is set without HEALTH_CHECK_USER; replication lag is never measured and no replica is kept out of reads")
+		} else if interval := time.Duration(config.pingInterval) * time.Minute; interval > config.replicaMaxLag {
+			logger.Warn().Msgf("Replication lag is only measured every %s (PING_INTERVAL), longer than REPLICA_MAX_LAG of %s", interval, config.replicaMaxLag)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -98,18 +132,24 @@ func NewProxy(config *Config, db *sql.DB, logger zerolog.Logger) *Proxy {
 	healthCheckStore := store.NewHealthCheckStore(&logger, gormDB)
 	logsStore := store.NewLogStore(gormDB, &logger)
 	sqlStore := store.NewSQLStore(gormDB, &logger)
+	credentialStore := store.NewUpstreamCredentialStore(&logger, gormDB)
+	firewallStore := store.NewFirewallRuleStore(&logger, gormDB)
+	allowlistStore := store.NewAllowlistStore(&logger, gormDB)
 
 	p := &Proxy{
 		config:       config,
 		logger:       &logger,
 		sqliteDB:     db,
+		primary:      primary,
 		servers:      servers,
 		ctx:          ctx,
 		cancel:       cancel,
-		serverIndex:  uint64(0),
+		balancers:    balancers,
 		unhealthy:    unhealthy,
 		lock:         sync.Mutex{},
 		pingInterval: time.Duration(config.pingInterval) * time.Minute,
+		tlsConfig:    tlsConfig,
+		sessions:     make(map[cancelKey]*Session),
 
 		store: struct {
 			healthCheckStore store.HealthCheckInterface
@@ -117,18 +157,39 @@ func NewProxy(config *Config, db *sql.DB, logger zerolog.Logger) *Proxy {
 			requestStore     store.RequestInterface
 			logsStore        store.LogsInterface
 			sqlStore         store.SQLInterface
+			credentialStore  store.UpstreamCredentialInterface
+			firewallStore    store.FirewallRuleInterface
+			allowlistStore   store.AllowlistInterface
 		}{
 			healthCheckStore: healthCheckStore,
 			userStore:        userStore,
 			requestStore:     requestStore,
 			logsStore:        logsStore,
 			sqlStore:         sqlStore,
+			credentialStore:  credentialStore,
+			firewallStore:    firewallStore,
+			allowlistStore:   allowlistStore,
 		},
 	}
 
+	if err = p.loadFirewallRules(ctx, uuid.New()); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load firewall rules")
+	}
+
+	if err = p.loadAllowlist(ctx, uuid.New()); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load query allowlist")
+	}
+
+	p.allowlist.queue = make(chan store.AllowlistEntry, fingerprintQueueSize)
+	if config.allowlistLearnFor > 0 {
+		p.allowlist.learnUntil = time.Now().Add(config.allowlistLearnFor)
+	}
+
+	go p.recordFingerprints()
+
 	// Start pinging for each upstream
 	p.healthCheck()
-	p.initializePatterns()
+	go p.reapPools()
 
 	return p
 }
@@ -2,53 +2,104 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-// Start runs the proxy server
+// Start runs the proxy server, accepting clients on every configured listener
 func (p *Proxy) Start() error {
-	listener, err := net.Listen("tcp", p.config.listenAddr)
-	if err != nil {
-		p.logger.
-			Error().
-			Err(err).
-			Msg("failed to listen on " + p.config.listenAddr)
-
-		return fmt.Errorf("failed to listen on %s: %v", p.config.listenAddr, err)
+	if len(p.config.listeners) == 0 {
+		return fmt.Errorf("no listen address configured")
 	}
 
-	defer func(listener net.Listener) {
-		if err := listener.Close(); err != nil {
-			p.logger.Error().Err(err).Msgf("Failed to close listener: %v", err)
+	listeners := make([]net.Listener, 0, len(p.config.listeners))
+
+	defer func() {
+		for _, listener := range listeners {
+			if err := listener.Close(); err != nil {
+				p.logger.Error().Err(err).Msgf("Failed to close listener: %v", err)
+			}
+		}
+	}()
+
+	for _, config := range p.config.listeners {
+		if config.poolMode != PoolModeSession && config.poolMode != PoolModeTransaction {
+			return fmt.Errorf("invalid pool mode %q for %s", config.poolMode, config.addr)
 		}
-	}(listener)
 
-	p.logger.Info().Msgf("Proxy listening on %s", p.config.listenAddr)
+		if _, ok := p.balancers[config.replicaGroup]; !ok {
+			return fmt.Errorf("no replica is in group %q of %s", config.replicaGroup, config.addr)
+		}
+
+		listener, err := net.Listen("tcp", config.addr)
+		if err != nil {
+			p.logger.
+				Error().
+				Err(err).
+				Msg("failed to listen on " + config.addr)
+
+			return fmt.Errorf("failed to listen on %s: %v", config.addr, err)
+		}
+
+		listeners = append(listeners, listener)
+
+		p.logger.Info().Msgf("Proxy listening on %s in %s pool mode", config.addr, config.poolMode)
+	}
+
+	var wg sync.WaitGroup
+
+	for i, listener := range listeners {
+		wg.Add(1)
 
+		go func(listener net.Listener, config ListenerConfig) {
+			defer wg.Done()
+
+			p.serve(listener, config)
+		}(listener, p.config.listeners[i])
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+// serve accepts clients on listener until it is closed
+func (p *Proxy) serve(listener net.Listener, config ListenerConfig) {
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
 			p.logger.Error().Err(err).Msgf("Failed to accept connection: %v", err)
 			continue
 		}
 
-		ctx, _ := context.WithTimeout(context.Background(), 1*time.Minute)
-
-		go p.handleConnection(&Request{
-			ID:        uuid.New(),
-			Sql:       nil,
-			CreatedAt: time.Now(),
-			ctx:       ctx,
-			connID:    atomic.AddUint64(&p.connCounter, 1),
-			requestID: uuid.New(),
-			UserID:    uuid.UUID{},
-			conn:      clientConn,
-		})
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+
+		go func() {
+			defer cancel()
+
+			p.handleConnection(&Request{
+				ID:           uuid.New(),
+				Sql:          nil,
+				CreatedAt:    time.Now(),
+				ctx:          ctx,
+				connID:       atomic.AddUint64(&p.connCounter, 1),
+				requestID:    uuid.New(),
+				UserID:       uuid.UUID{},
+				conn:         clientConn,
+				poolMode:     config.poolMode,
+				replicaGroup: config.replicaGroup,
+			})
+		}()
 	}
 }
 
@@ -69,8 +120,15 @@ func (p *Proxy) Close() error {
 	}
 
 	// Close all connections
-	for _, v := range p.servers {
-		v.pool.Close()
+	p.lock.Lock()
+	upstreams := append([]*Upstream{p.primary}, p.servers...)
+	upstreams = append(upstreams, p.unhealthy...)
+	p.lock.Unlock()
+
+	for _, upstream := range upstreams {
+		if pool := upstream.pool.Load(); pool != nil {
+			pool.Close()
+		}
 	}
 
 	return nil
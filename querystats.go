@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"thesis/sqlparser"
+)
+
+const (
+	// maxQueryFingerprints bounds the fingerprints the query statistics
+	// keep; past it the least called one makes way for a new one
+	maxQueryFingerprints = 5000
+
+	// latencySamples is how many of the latest calls p95 latency is taken over
+	latencySamples = 512
+)
+
+// Columns /stats/queries sorts by
+var queryStatsColumns = []string{"calls", "total_time", "mean_time", "p95_time", "rows", "errors"}
+
+// queryStats aggregates the statements clients run by fingerprint, in the
+// manner of pg_stat_statements, with a breakdown by proxy user and upstream
+type queryStats struct {
+	lock    sync.Mutex
+	queries map[string]*fingerprintStats
+}
+
+type fingerprintStats struct {
+	query     string // the normalized statement
+	all       statCounters
+	users     map[string]*statCounters
+	upstreams map[string]*statCounters
+}
+
+// statCounters count the calls of a fingerprint. Calls that failed count as
+// calls and errors both.
+type statCounters struct {
+	calls     uint64
+	rows      uint64
+	errors    uint64
+	totalTime time.Duration
+	latencies []time.Duration // the latest calls, a ring of latencySamples
+	next      int             // where the ring is written next once full
+}
+
+func (c *statCounters) add(latency time.Duration, rows uint64, failed bool) {
+	c.calls++
+	c.rows += rows
+	c.totalTime += latency
+
+	if failed {
+		c.errors++
+	}
+
+	if len(c.latencies) < latencySamples {
+		c.latencies = append(c.latencies, latency)
+		return
+	}
+
+	c.latencies[c.next] = latency
+	c.next = (c.next + 1) % latencySamples
+}
+
+func (c *statCounters) counters() QueryCounters {
+	counters := QueryCounters{
+		Calls:       c.calls,
+		Rows:        c.rows,
+		Errors:      c.errors,
+		TotalTimeMs: milliseconds(c.totalTime),
+	}
+
+	if c.calls > 0 {
+		counters.MeanTimeMs = milliseconds(c.totalTime / time.Duration(c.calls))
+	}
+
+	if len(c.latencies) > 0 {
+		sorted := slices.Clone(c.latencies)
+		slices.Sort(sorted)
+
+		counters.P95TimeMs = milliseconds(sorted[(len(sorted)*95+99)/100-1])
+	}
+
+	return counters
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// record counts one call of statement by user on upstream
+func (q *queryStats) record(statement sqlparser.Statement, user, upstream string, latency time.Duration, rows uint64, failed bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats, ok := q.queries[statement.Fingerprint]
+	if !ok {
+		if q.queries == nil {
+			q.queries = make(map[string]*fingerprintStats)
+		}
+
+		if len(q.queries) >= maxQueryFingerprints {
+			q.evict()
+		}
+
+		stats = &fingerprintStats{
+			query:     statement.Normalized,
+			users:     make(map[string]*statCounters),
+			upstreams: make(map[string]*statCounters),
+		}
+
+		q.queries[statement.Fingerprint] = stats
+	}
+
+	stats.all.add(latency, rows, failed)
+	countersOf(stats.users, user).add(latency, rows, failed)
+	countersOf(stats.upstreams, upstream).add(latency, rows, failed)
+}
+
+// countersOf returns the counters of key in a breakdown, adding them when
+// missing
+func countersOf(breakdown map[string]*statCounters, key string) *statCounters {
+	counters, ok := breakdown[key]
+	if !ok {
+		counters = &statCounters{}
+		breakdown[key] = counters
+	}
+
+	return counters
+}
+
+// evict drops the least called fingerprint. The caller must hold q.lock.
+func (q *queryStats) evict() {
+	var (
+		least string
+		calls uint64
+	)
+
+	for fingerprint, stats := range q.queries {
+		if least == "" || stats.all.calls < calls {
+			least, calls = fingerprint, stats.all.calls
+		}
+	}
+
+	delete(q.queries, least)
+}
+
+// QueryCounters are the counters of a fingerprint as served on /stats/queries
+type QueryCounters struct {
+	Calls       uint64  `json:"calls"`
+	TotalTimeMs float64 `json:"total_time_ms"`
+	MeanTimeMs  float64 `json:"mean_time_ms"`
+	P95TimeMs   float64 `json:"p95_time_ms"`
+	Rows        uint64  `json:"rows"`
+	Errors      uint64  `json:"errors"`
+}
+
+// column returns the counter /stats/queries sorts by
+func (c QueryCounters) column(name string) float64 {
+	switch name {
+	case "total_time":
+		return c.TotalTimeMs
+	case "mean_time":
+		return c.MeanTimeMs
+	case "p95_time":
+		return c.P95TimeMs
+	case "rows":
+		return float64(c.Rows)
+	case "errors":
+		return float64(c.Errors)
+	default:
+		return float64(c.Calls)
+	}
+}
+
+// QueryStats is one fingerprint as served on /stats/queries, with its
+// counters by proxy user and by upstream name
+type QueryStats struct {
+	Fingerprint string `json:"fingerprint"`
+	Query       string `json:"query"`
+	QueryCounters
+	Users     map[string]QueryCounters `json:"users"`
+	Upstreams map[string]QueryCounters `json:"upstreams"`
+}
+
+// top returns the limit fingerprints with the highest value in column
+func (q *queryStats) top(column string, limit int) []QueryStats {
+	q.lock.Lock()
+
+	result := make([]QueryStats, 0, len(q.queries))
+	for fingerprint, stats := range q.queries {
+		entry := QueryStats{
+			Fingerprint:   fingerprint,
+			Query:         stats.query,
+			QueryCounters: stats.all.counters(),
+			Users:         make(map[string]QueryCounters, len(stats.users)),
+			Upstreams:     make(map[string]QueryCounters, len(stats.upstreams)),
+		}
+
+		for user, counters := range stats.users {
+			entry.Users[user] = counters.counters()
+		}
+
+		for upstream, counters := range stats.upstreams {
+			entry.Upstreams[upstream] = counters.counters()
+		}
+
+		result = append(result, entry)
+	}
+
+	q.lock.Unlock()
+
+	slices.SortFunc(result, func(a, b QueryStats) int {
+		if c := cmp.Compare(b.column(column), a.column(column)); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.Fingerprint, b.Fingerprint)
+	})
+
+	return result[:min(limit, len(result))]
+}
+
+// statementRun times the statements a reply covers as the backend gets
+// through them: those of a simple query one after another, or the one
+// statement an Execute runs
+type statementRun struct {
+	statements []sqlparser.Statement
+	next       int       // the statement the backend is running
+	started    time.Time // when it was sent, or when the one before it completed
+	rows       uint64    // DataRows forwarded for it
+}
+
+// newStatementRun returns the run of the statements of query, or nil when
+// there are none to time
+func newStatementRun(query string) *statementRun {
+	_, query = parseHints(query)
+
+	statements, err := sqlparser.Parse(query)
+	if err != nil || len(statements) == 0 {
+		return nil
+	}
+
+	return &statementRun{statements: statements, started: time.Now()}
+}
+
+// observe counts a backend message towards the statement being run and
+// records it in stats once the message ends it. A statement running when an
+// error arrives failed; the ones after it never run.
+func (r *statementRun) observe(stats *queryStats, user, upstream string, msg []byte, since time.Time) {
+	if r.next >= len(r.statements) {
+		return
+	}
+
+	var failed bool
+
+	switch msg[0] {
+	case 'D':
+		r.rows++
+		return
+	case 'C':
+		if rows, ok := commandRows(msg[5:]); ok {
+			r.rows = rows
+		}
+	case 's':
+		// a portal suspended after returning as many rows as were asked for
+	case 'E':
+		failed = true
+	default:
+		return
+	}
+
+	now := time.Now()
+	started := r.started
+	if since.After(started) {
+		started = since
+	}
+
+	stats.record(r.statements[r.next], user, upstream, now.Sub(started), r.rows, failed)
+
+	r.next, r.started, r.rows = r.next+1, now, 0
+
+	if failed {
+		r.next = len(r.statements)
+	}
+}
+
+// commandRows returns the rows a CommandComplete tag reports, as the 5 of
+// SELECT 5 or INSERT 0 5
+func commandRows(body []byte) (uint64, bool) {
+	tag := bytes.TrimRight(body, "\x00")
+
+	i := bytes.LastIndexByte(tag, ' ')
+	if i < 0 {
+		return 0, false
+	}
+
+	rows, err := strconv.ParseUint(string(tag[i+1:]), 10, 64)
+
+	return rows, err == nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// authorizeQuery checks whether role may run every statement of query. It
+// returns the ErrorResponse to send the client when it may not, nil
+// otherwise; a query string is refused as a whole for any one statement.
+func (p *Proxy) authorizeQuery(role UserRole, query string) []byte {
+	if len(query) == 0 || role != UserRoleReadOnly {
+		return nil
+	}
+
+	statements, refused := parseQuery(query)
+	if refused != nil {
+		return refused
+	}
+
+	// transaction and session control need the primary but change nothing
+	for _, statement := range statements {
+		if statement.Modifies {
+			return encodeError("ERROR", "42501", fmt.Sprintf("permission denied: role %s cannot execute write statements", role))
+		}
+	}
+
+	return nil
+}
+
+// authorizeFunctionCall checks whether the session's user may make the
+// fast-path FunctionCall in msg. The call names its function by OID and has no
+// fingerprint, so users held to the allowlist in enforce mode have to call
+// functions from a query instead. Read-only users may call the functions the
+// primary's catalog marks IMMUTABLE or STABLE, which cannot modify data.
+func (p *Proxy) authorizeFunctionCall(session *Session, msg []byte) []byte {
+	if p.config.allowlistMode == AllowlistEnforce && session.role != UserRoleAdmin {
+		return encodeError("ERROR", "42501", fmt.Sprintf("permission denied: role %s cannot use fast-path function calls", session.role))
+	}
+
+	if session.role != UserRoleReadOnly {
+		return nil
+	}
+
+	denied := encodeError("ERROR", "42501", fmt.Sprintf("permission denied: role %s cannot make fast-path calls to functions that may modify data", session.role))
+
+	if len(msg) < 9 {
+		return denied
+	}
+
+	oid := binary.BigEndian.Uint32(msg[5:9])
+
+	row, err := p.queryUpstream(session, p.primary, fmt.Sprintf("SELECT provolatile FROM pg_catalog.pg_proc WHERE oid = %d", oid))
+	if err != nil {
+		p.logger.Warn().Err(err).Msgf("[Conn %d] Cannot look up the volatility of function %d: %v", session.request.connID, oid, err)
+		return denied
+	}
+
+	// no row means there is no such function
+	if len(row) != 1 || (row[0] != "i" && row[0] != "s") {
+		return denied
+	}
+
+	return nil
+}
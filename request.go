@@ -11,16 +11,18 @@ import (
 )
 
 type Request struct {
-	ID          uuid.UUID
-	UserID      uuid.UUID
-	Sql         []SQL
-	CreatedAt   time.Time
-	CompletedAt *time.Time
-	conn        net.Conn
-	connID      uint64
-	ctx         context.Context
-	requestID   uuid.UUID
-	serverAddr  *string
+	ID           uuid.UUID
+	UserID       uuid.UUID
+	Sql          []SQL
+	CreatedAt    time.Time
+	CompletedAt  *time.Time
+	conn         net.Conn
+	connID       uint64
+	ctx          context.Context
+	requestID    uuid.UUID
+	serverAddr   *string
+	poolMode     string // pool mode of the listener the client connected to
+	replicaGroup string // replica group of that listener, "" for all replicas
 }
 
 type SQL struct {
@@ -28,6 +30,12 @@ type SQL struct {
 	CreatedAt   time.Time
 	CompletedAt *time.Time
 	IsRead      bool
+	Rejected    bool
+	Hint        string     // routing hints the statement carried, as name=value pairs
+	Type        string     // the command, as in SELECT or CREATE TABLE
+	Tables      string     // the tables it names, comma-separated
+	RuleID      *uuid.UUID // the firewall rule that blocked it
+	blocked     int        // which statement of the query string the rule blocked
 }
 
 func (p *Proxy) InsertRequest(request Request) error {
@@ -80,6 +88,11 @@ func (r *Request) IntoDBSQL() []store.SQL {
 			CreatedAt:   v.CreatedAt,
 			CompletedAt: v.CompletedAt,
 			IsRead:      v.IsRead,
+			Rejected:    v.Rejected,
+			Hint:        v.Hint,
+			Type:        v.Type,
+			Tables:      v.Tables,
+			RuleID:      v.RuleID,
 		})
 	}
 
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync/atomic"
+	"time"
+)
+
+// lookupTimeout bounds a query the proxy runs for itself on a borrowed
+// backend session
+const lookupTimeout = 2 * time.Second
+
+// backendFor picks the backend a statement of the given class runs on. Writes
+// go to the primary and reads to a replica, opened on first use; statements
+// that cannot be classified stay on the backend the session last used. A
+// pinned session runs everything on the primary. Inside a transaction block
+// every statement stays on the backend running it.
+func (p *Proxy) backendFor(session *Session, class QueryClass) (*backendConn, error) {
+	// a session reading its own writes reads from the primary until a
+	// replica has them
+	switch {
+	case class == QueryWrite:
+		session.noteWrite()
+	case class == QueryRead && p.readsFromPrimary(session):
+		class = QueryWrite
+	}
+
+	if session.poolMode == PoolModeTransaction {
+		return p.borrowBackend(session, class)
+	}
+
+	target := session.primary
+
+	switch {
+	case session.isPinned():
+		// the state the session left behind lives on the primary backend
+	case class == QueryUnknown:
+		target = session.current
+	case class == QueryRead:
+		if replica := p.replicaFor(session); replica != nil {
+			target = replica
+		}
+	}
+
+	if target != session.current {
+		// the previous backend must answer everything it was sent before
+		// the next backend starts writing to the client, which also brings
+		// its transaction status up to date
+		session.waitIdle()
+
+		// pinned from BEGIN until ReadyForQuery reports idle again
+		if session.current.inTransaction() {
+			return session.current, nil
+		}
+
+		if err := p.syncSettings(session, target); err != nil {
+			return nil, err
+		}
+
+		// only the frontend goroutine moves the session, cancel requests read it
+		session.lock.Lock()
+		session.current = target
+		session.lock.Unlock()
+	}
+
+	return target, nil
+}
+
+// syncSettings applies the session's settings to a backend it moves to. A SET
+// the client ran on its other backend since it last used this one is
+// replayed here, with the statements setParams would send.
+func (p *Proxy) syncSettings(session *Session, backend *backendConn) error {
+	session.lock.Lock()
+	settings := make(map[string]string, len(session.settings))
+	maps.Copy(settings, session.settings)
+	query, ok := settingsQuery(backend.server.settings, settings)
+	session.lock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return p.send(backend, session, encodeSimpleQuery(query), &pendingReply{msgType: 'Q', discard: true, settings: settings})
+}
+
+// borrowBackend is backendFor in transaction pooling. A pinned session moves
+// to the primary and stays on the backend it gets there for good, as in
+// session pooling.
+func (p *Proxy) borrowBackend(session *Session, class QueryClass) (*backendConn, error) {
+	pinned := session.isPinned()
+	if pinned {
+		class = QueryWrite
+	}
+
+	backend, err := p.attachBackend(session, class)
+	if err != nil || !pinned || backend.upstream.Role != UpstreamPrimary {
+		return backend, err
+	}
+
+	session.lock.Lock()
+	session.poolMode = PoolModeSession
+	session.primary = backend
+	session.lock.Unlock()
+
+	atomic.AddInt64(&p.stats.pinnedSessions, 1)
+	atomic.AddUint64(&p.stats.pinnedSessionsTotal, 1)
+
+	p.logger.Info().Msgf("[Conn %d] Session pinned to backend %s", session.request.connID, backend.upstream.Addr)
+
+	return backend, nil
+}
+
+// attachBackend returns the backend the session has borrowed while that
+// backend still owes replies or has a transaction open; otherwise it borrows
+// one from the primary's pool, or a replica's for reads. Reads a hint sends
+// to a named replica are borrowed from that replica's pool.
+func (p *Proxy) attachBackend(session *Session, class QueryClass) (*backendConn, error) {
+	var hinted *Upstream
+	if class == QueryRead {
+		hinted = session.upstreamHint
+	}
+
+	if current := session.attached(); current != nil {
+		isReplica := current.upstream.Role == UpstreamReplica
+		if class == QueryUnknown || (isReplica == (class == QueryRead) && (hinted == nil || current.upstream == hinted)) {
+			return current, nil
+		}
+
+		// the backend goes back to its pool once it has answered, unless
+		// a transaction block pins the session to it
+		session.waitIdle()
+
+		if current = session.attached(); current != nil {
+			return current, nil
+		}
+	}
+
+	var (
+		backend *backendConn
+		err     error
+	)
+
+	switch {
+	case hinted != nil:
+		if backend, err = p.openBackend(session, hinted); err != nil {
+			p.logger.Warn().Err(err).Msgf("[Conn %d] Read goes to the primary: %v", session.request.connID, err)
+		}
+	case class == QueryRead:
+		if backend, err = p.openReplica(session); err != nil {
+			p.logger.Warn().Err(err).Msgf("[Conn %d] Read goes to the primary: %v", session.request.connID, err)
+		}
+	}
+
+	if backend == nil {
+		if backend, err = p.openPrimary(session); err != nil {
+			code, message := "08001", "cannot get backend connection"
+
+			var exhausted *poolExhaustedError
+			if errors.As(err, &exhausted) {
+				code, message = "53300", exhausted.Error()
+			}
+
+			session.lock.Lock()
+			_ = writeError(session.request.conn, "FATAL", code, message)
+			session.lock.Unlock()
+
+			return nil, err
+		}
+	}
+
+	session.lock.Lock()
+	session.current = backend
+	session.lock.Unlock()
+
+	p.startBackend(session, backend)
+
+	return backend, nil
+}
+
+// route sends data to the backend for statements of the given class. A
+// backend handed back to its pool just before the data reached it is
+// replaced by a newly borrowed one.
+func (p *Proxy) route(session *Session, class QueryClass, data []byte, replies ...*pendingReply) error {
+	for {
+		backend, err := p.backendFor(session, class)
+		if err != nil {
+			return err
+		}
+
+		if err = p.send(backend, session, data, replies...); !errors.Is(err, errBackendReleased) {
+			return err
+		}
+	}
+}
+
+// replicaFor returns the session's replica backend, opening one on first use.
+// It returns nil when no replica session can be had, so reads use the primary.
+// A hint naming another replica moves the session's reads there.
+func (p *Proxy) replicaFor(session *Session) *backendConn {
+	hinted := session.upstreamHint
+	if hinted != nil && session.replica != nil && session.replica.upstream != hinted {
+		p.dropReplica(session)
+	}
+
+	if session.replica != nil || (session.noReplica && hinted == nil) {
+		return session.replica
+	}
+
+	var (
+		replica *backendConn
+		err     error
+	)
+
+	if hinted != nil {
+		replica, err = p.openBackend(session, hinted)
+	} else {
+		replica, err = p.openReplica(session)
+	}
+
+	if err != nil {
+		p.logger.Warn().Err(err).Msgf("[Conn %d] Reads stay on the primary: %v", session.request.connID, err)
+
+		// only a failed hint is worth trying again
+		session.noReplica = session.noReplica || hinted == nil
+		return nil
+	}
+
+	session.lock.Lock()
+	session.replica = replica
+	session.lock.Unlock()
+
+	p.startBackend(session, replica)
+
+	return replica
+}
+
+// dropReplica hands the session's replica back to its pool once it has
+// answered. A replica in a transaction block is kept, and so is one that
+// cannot be reset while it still serves the session.
+func (p *Proxy) dropReplica(session *Session) {
+	replica := session.replica
+
+	session.waitIdle()
+
+	if replica.inTransaction() {
+		return
+	}
+
+	err := p.resetBackend(session, replica)
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if !replica.done {
+		p.logger.Warn().Err(err).Msgf("[Conn %d] Keeping replica %s: %v", session.request.connID, replica.upstream.Addr, err)
+		return
+	}
+
+	session.replica = nil
+	if session.current == replica {
+		session.current = session.primary
+	}
+}
+
+// openReplica takes a session for the client's user and database from a
+// healthy replica's pool and applies the client's startup parameters to it.
+func (p *Proxy) openReplica(session *Session) (*backendConn, error) {
+	upstream := p.pickReplica(session)
+	if upstream == nil {
+		return nil, fmt.Errorf("no healthy replica")
+	}
+
+	return p.openBackend(session, upstream)
+}
+
+// openPrimary is openReplica for the primary
+func (p *Proxy) openPrimary(session *Session) (*backendConn, error) {
+	if !p.primary.Healthy {
+		return nil, fmt.Errorf("the primary server is down")
+	}
+
+	return p.openBackend(session, p.primary)
+}
+
+func (p *Proxy) openBackend(session *Session, upstream *Upstream) (*backendConn, error) {
+	pool := upstream.pool.Load()
+	if pool == nil {
+		return nil, fmt.Errorf("upstream %s has no connection pool", upstream.Addr)
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, 1*time.Minute)
+	defer cancel()
+
+	server, err := pool.Get(ctx, session.poolKey, session.credential)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get connection to %s: %w", upstream.Addr, err)
+	}
+
+	if err = server.setParams(session.settingsSnapshot()); err != nil {
+		pool.releaseFailed(server, err)
+		return nil, err
+	}
+
+	return newBackendConn(upstream, pool, server), nil
+}
+
+// startBackend starts the goroutine copying a backend's responses to the client
+func (p *Proxy) startBackend(session *Session, backend *backendConn) {
+	session.wg.Add(1)
+
+	go p.backend(session, backend)
+}
+
+// resetBackends resets the session's backends with DISCARD ALL once the client
+// is gone, so that they can go back to their pools. Backends that cannot be
+// reset are closed, which also ends their goroutines.
+func (p *Proxy) resetBackends(session *Session) {
+	for _, backend := range session.backends() {
+		if err := p.resetBackend(session, backend); err != nil {
+			p.logger.Warn().Err(err).Msgf("[Conn %d] Closing backend %s: %v", session.request.connID, backend.upstream.Addr, err)
+			_ = backend.conn.Close()
+		}
+	}
+}
+
+// resetBackend rolls back any open transaction, runs DISCARD ALL and waits for
+// the backend goroutine to hand the connection back
+func (p *Proxy) resetBackend(session *Session, backend *backendConn) error {
+	session.lock.Lock()
+	idle := len(session.replies) == 0 && !backend.done
+	session.lock.Unlock()
+
+	// a backend still answering the client is in an unknown state
+	if !idle {
+		return fmt.Errorf("backend is busy")
+	}
+
+	if err := backend.conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return err
+	}
+
+	var (
+		data    []byte
+		replies []*pendingReply
+	)
+
+	if backend.inTransaction() {
+		data = encodeSimpleQuery("ROLLBACK")
+		replies = append(replies, &pendingReply{msgType: 'Q', discard: true})
+	}
+
+	data = append(data, encodeSimpleQuery("DISCARD ALL")...)
+	replies = append(replies, &pendingReply{msgType: 'Q', discard: true, release: true})
+
+	if err := p.send(backend, session, data, replies...); err != nil {
+		return err
+	}
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	for !backend.done {
+		session.cond.Wait()
+	}
+
+	if !backend.reusable {
+		return fmt.Errorf("DISCARD ALL failed")
+	}
+
+	return nil
+}
+
+// queryUpstream runs a query of the proxy's own on a session borrowed from
+// upstream's pool for the client's user and database, and returns the first
+// row of its result
+func (p *Proxy) queryUpstream(session *Session, upstream *Upstream, query string) ([]string, error) {
+	pool := upstream.pool.Load()
+	if pool == nil {
+		return nil, fmt.Errorf("upstream %s has no connection pool", upstream.Addr)
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, lookupTimeout)
+	defer cancel()
+
+	server, err := pool.Get(ctx, session.poolKey, session.credential)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := queryRow(server.conn, query)
+	if err != nil {
+		pool.Discard(server)
+		return nil, err
+	}
+
+	pool.Release(server)
+
+	return row, nil
+}
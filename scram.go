@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	scramMechanism  = "SCRAM-SHA-256"
+	scramIterations = 4096
+	scramSaltLength = 16
+	scramNonceBytes = 18
+)
+
+// scramVerifier holds what the server needs to check a SCRAM-SHA-256 proof
+// without knowing the password. It is stored in PostgreSQL's format:
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+type scramVerifier struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// newScramVerifier derives a verifier for password with a fresh random salt
+func newScramVerifier(password string) (*scramVerifier, error) {
+	salt := make([]byte, scramSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	saltedPassword, err := pbkdf2.Key(sha256.New, password, salt, scramIterations, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	return &scramVerifier{
+		iterations: scramIterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  scramHMAC(saltedPassword, "Server Key"),
+	}, nil
+}
+
+// scramVerifierFor returns the encoded verifier stored for a new password
+func scramVerifierFor(password string) (string, error) {
+	verifier, err := newScramVerifier(password)
+	if err != nil {
+		return "", err
+	}
+
+	return verifier.String(), nil
+}
+
+func parseScramVerifier(encoded string) (*scramVerifier, error) {
+	invalid := fmt.Errorf("invalid SCRAM verifier")
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 3 || parts[0] != scramMechanism {
+		return nil, invalid
+	}
+
+	iterationsStr, saltStr, ok := strings.Cut(parts[1], ":")
+	if !ok {
+		return nil, invalid
+	}
+
+	storedKeyStr, serverKeyStr, ok := strings.Cut(parts[2], ":")
+	if !ok {
+		return nil, invalid
+	}
+
+	iterations, err := strconv.Atoi(iterationsStr)
+	if err != nil || iterations <= 0 {
+		return nil, invalid
+	}
+
+	verifier := &scramVerifier{iterations: iterations}
+
+	for _, field := range []struct {
+		dst *[]byte
+		src string
+	}{
+		{&verifier.salt, saltStr},
+		{&verifier.storedKey, storedKeyStr},
+		{&verifier.serverKey, serverKeyStr},
+	} {
+		if *field.dst, err = base64.StdEncoding.DecodeString(field.src); err != nil {
+			return nil, invalid
+		}
+	}
+
+	return verifier, nil
+}
+
+func (v *scramVerifier) String() string {
+	return fmt.Sprintf("%s$%d:%s$%s:%s",
+		scramMechanism,
+		v.iterations,
+		base64.StdEncoding.EncodeToString(v.salt),
+		base64.StdEncoding.EncodeToString(v.storedKey),
+		base64.StdEncoding.EncodeToString(v.serverKey),
+	)
+}
+
+// scramServer runs the server side of one SCRAM-SHA-256 exchange (RFC 5802, RFC 7677)
+type scramServer struct {
+	verifier        *scramVerifier
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+// handleClientFirst parses the client-first-message and returns the server-first-message
+func (s *scramServer) handleClientFirst(message string) (string, error) {
+	// gs2-header: channel binding flag, optional authzid, then the bare message
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed SCRAM client-first-message")
+	}
+
+	switch {
+	case parts[0] == "n", parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return "", fmt.Errorf("SCRAM channel binding is not supported")
+	default:
+		return "", fmt.Errorf("malformed SCRAM channel binding flag")
+	}
+
+	if parts[1] != "" {
+		return "", fmt.Errorf("SCRAM authorization identity is not supported")
+	}
+
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	// the user name is taken from the startup message, as PostgreSQL does
+	var clientNonce string
+	for _, attr := range strings.Split(s.clientFirstBare, ",") {
+		if strings.HasPrefix(attr, "r=") {
+			clientNonce = attr[2:]
+		}
+	}
+
+	if clientNonce == "" {
+		return "", fmt.Errorf("SCRAM client nonce is missing")
+	}
+
+	serverNonce := make([]byte, scramNonceBytes)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	s.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d",
+		s.nonce,
+		base64.StdEncoding.EncodeToString(s.verifier.salt),
+		s.verifier.iterations,
+	)
+
+	return s.serverFirst, nil
+}
+
+// handleClientFinal checks the client's proof and returns the server-final-message
+func (s *scramServer) handleClientFinal(message string) (string, error) {
+	withoutProof, proofAttr, ok := strings.Cut(message, ",p=")
+	if !ok {
+		return "", fmt.Errorf("SCRAM client proof is missing")
+	}
+
+	var channelBinding, nonce string
+	for _, attr := range strings.Split(withoutProof, ",") {
+		switch {
+		case strings.HasPrefix(attr, "c="):
+			channelBinding = attr[2:]
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		}
+	}
+
+	if channelBinding != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return "", fmt.Errorf("SCRAM channel binding does not match")
+	}
+
+	if nonce != s.nonce {
+		return "", fmt.Errorf("SCRAM nonce does not match")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(proofAttr)
+	if err != nil || len(proof) != sha256.Size {
+		return "", fmt.Errorf("malformed SCRAM client proof")
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+
+	// ClientKey = ClientProof XOR HMAC(StoredKey, AuthMessage)
+	clientKey := scramHMAC(s.verifier.storedKey, authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.verifier.storedKey) != 1 {
+		return "", fmt.Errorf("SCRAM client proof does not match")
+	}
+
+	serverSignature := scramHMAC(s.verifier.serverKey, authMessage)
+
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+
+	return mac.Sum(nil)
+}
+
+// scramClient runs the client side of one SCRAM-SHA-256 exchange, used when
+// the proxy authenticates to a backend
+type scramClient struct {
+	password        string
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool // the server proved it knows the password
+}
+
+func newScramClient(password string) (*scramClient, error) {
+	nonce := make([]byte, scramNonceBytes)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	c := &scramClient{
+		password:    password,
+		clientNonce: base64.RawStdEncoding.EncodeToString(nonce),
+	}
+
+	// the server takes the user name from the startup message
+	c.clientFirstBare = "n=,r=" + c.clientNonce
+
+	return c, nil
+}
+
+// clientFirst returns the client-first-message, without channel binding
+func (c *scramClient) clientFirst() string {
+	return "n,," + c.clientFirstBare
+}
+
+// handleServerFirst parses the server-first-message and returns the client-final-message
+func (c *scramClient) handleServerFirst(message string) (string, error) {
+	var (
+		nonce, salt string
+		iterations  int
+		err         error
+	)
+
+	for _, attr := range strings.Split(message, ",") {
+		switch {
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		case strings.HasPrefix(attr, "s="):
+			salt = attr[2:]
+		case strings.HasPrefix(attr, "i="):
+			if iterations, err = strconv.Atoi(attr[2:]); err != nil {
+				return "", fmt.Errorf("malformed SCRAM iteration count")
+			}
+		}
+	}
+
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return "", fmt.Errorf("SCRAM server nonce does not extend the client nonce")
+	}
+
+	if iterations <= 0 {
+		return "", fmt.Errorf("malformed SCRAM iteration count")
+	}
+
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("malformed SCRAM salt")
+	}
+
+	saltedPassword, err := pbkdf2.Key(sha256.New, c.password, saltBytes, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + message + "," + withoutProof
+
+	// ClientProof = ClientKey XOR HMAC(H(ClientKey), AuthMessage)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := scramHMAC(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	c.serverSignature = scramHMAC(scramHMAC(saltedPassword, "Server Key"), authMessage)
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal checks the server's signature in the server-final-message
+func (c *scramClient) verifyServerFinal(message string) error {
+	if strings.HasPrefix(message, "e=") {
+		return fmt.Errorf("SCRAM authentication failed: %s", message[2:])
+	}
+
+	if c.serverSignature == nil {
+		return fmt.Errorf("SCRAM server-final-message before server-first-message")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(message, "v="))
+	if err != nil || !hmac.Equal(signature, c.serverSignature) {
+		return fmt.Errorf("SCRAM server signature does not match")
+	}
+
+	c.verified = true
+
+	return nil
+}
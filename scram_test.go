@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// the SCRAM-SHA-256 exchange of RFC 7677, section 3
+const (
+	rfc7677Password        = "pencil"
+	rfc7677ClientNonce     = "rOprNGfwEbeRWgbNEkqO"
+	rfc7677ClientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfc7677ServerFirst     = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal     = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal     = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func rfc7677Verifier(t *testing.T) *scramVerifier {
+	t.Helper()
+
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+
+	saltedPassword, err := pbkdf2.Key(sha256.New, rfc7677Password, salt, 4096, sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storedKey := sha256.Sum256(scramHMAC(saltedPassword, "Client Key"))
+
+	return &scramVerifier{
+		iterations: 4096,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  scramHMAC(saltedPassword, "Server Key"),
+	}
+}
+
+func TestScramClientRFC7677(t *testing.T) {
+	client := &scramClient{
+		password:        rfc7677Password,
+		clientNonce:     rfc7677ClientNonce,
+		clientFirstBare: rfc7677ClientFirstBare,
+	}
+
+	final, err := client.handleServerFirst(rfc7677ServerFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if final != rfc7677ClientFinal {
+		t.Errorf("client-final-message = %q, want %q", final, rfc7677ClientFinal)
+	}
+
+	if err := client.verifyServerFinal("v=" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))); err == nil {
+		t.Error("a wrong server signature was accepted")
+	}
+
+	if err := client.verifyServerFinal(rfc7677ServerFinal); err != nil || !client.verified {
+		t.Errorf("server-final-message was refused: %v", err)
+	}
+}
+
+func TestScramServerRFC7677(t *testing.T) {
+	server := &scramServer{verifier: rfc7677Verifier(t)}
+
+	first, err := server.handleClientFirst("n,," + rfc7677ClientFirstBare)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(first, "r="+rfc7677ClientNonce) || !strings.HasSuffix(first, ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096") {
+		t.Fatalf("server-first-message = %q", first)
+	}
+
+	// replay the RFC's server nonce in place of the random one
+	server.serverFirst, server.nonce = rfc7677ServerFirst, strings.TrimPrefix(strings.Split(rfc7677ServerFirst, ",")[0], "r=")
+
+	final, err := server.handleClientFinal(rfc7677ClientFinal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if final != rfc7677ServerFinal {
+		t.Errorf("server-final-message = %q, want %q", final, rfc7677ServerFinal)
+	}
+
+	wrongProof := strings.Replace(rfc7677ClientFinal, "p=dHz", "p=dHy", 1)
+	if _, err := server.handleClientFinal(wrongProof); err == nil {
+		t.Error("a wrong client proof was accepted")
+	}
+}
+
+func TestScramVerifierRoundTrip(t *testing.T) {
+	verifier := rfc7677Verifier(t)
+
+	parsed, err := parseScramVerifier(verifier.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.String() != verifier.String() {
+		t.Errorf("parsed verifier = %s, want %s", parsed, verifier)
+	}
+
+	for _, encoded := range []string{"", "md5abc", "SCRAM-SHA-256$4096$a:b", "SCRAM-SHA-256$0:c2FsdA==$a2V5:a2V5"} {
+		if _, err := parseScramVerifier(encoded); err == nil {
+			t.Errorf("parseScramVerifier(%q) succeeded", encoded)
+		}
+	}
+}
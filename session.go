@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"thesis/store"
+)
+
+// Session holds the protocol state shared by the frontend and backend
+// goroutines of one client connection.
+type Session struct {
+	request    *Request
+	username   string // the proxy user the client logged in as
+	role       UserRole
+	poolMode   string                    // PoolModeSession or PoolModeTransaction
+	poolKey    PoolKey                   // database user and database of the backend sessions
+	settings   map[string]string         // client startup parameters applied to every backend session
+	credential *store.UpstreamCredential // backend login, nil when the backend needs no password
+	lock       sync.Mutex
+	cond       *sync.Cond
+	replies    []*pendingReply               // responses the client is waiting for, oldest first
+	statements map[string]*preparedStatement // the client's named prepared statements
+	txStatus   byte                          // status byte of the last ReadyForQuery
+	primary    *backendConn                  // nil in transaction pooling, where backends are borrowed per transaction
+	replica    *backendConn
+	current    *backendConn // backend the last statement was sent to, nil when none is borrowed
+	noReplica  bool         // no replica session could be opened; reads stay on the primary
+	pinned     bool         // the client left state in its backend session and keeps that backend
+	cancelKey  cancelKey    // key issued to the client in place of the backends' keys
+	wg         sync.WaitGroup
+	closeOnce  sync.Once
+
+	// read-your-writes state, owned by the frontend goroutine
+	consistency string    // ConsistencyEventual, ConsistencyWindow or ConsistencyLSN
+	lastWrite   time.Time // when the session last sent a write
+	writeLSN    uint64    // primary WAL position after the session's last write, 0 before any
+	lsnPending  bool      // a write was sent since writeLSN was looked up
+
+	// replica a /* goxy:upstream=name */ hint sends the statements being
+	// routed to, owned by the frontend goroutine
+	upstreamHint *Upstream
+
+	queryStats *queryStats // where the statements the backends complete are counted
+	lastReply  time.Time   // when a backend last completed a reply; the next one is timed from then at the earliest
+}
+
+// backendConn is a pooled backend session lent to one client
+type backendConn struct {
+	upstream *Upstream
+	pool     *ConnectionPool
+	server   *ServerConn
+	conn     net.Conn
+	txStatus byte       // status byte of the backend's last ReadyForQuery
+	key      *cancelKey // the server's BackendKeyData
+	dirty    bool       // resetting the session failed
+	reusable bool       // the session was reset and can go back to its pool
+	released bool       // nothing more may be sent; the session goes back to its pool
+	done     bool       // the goroutine reading from the backend has exited
+}
+
+func newBackendConn(upstream *Upstream, pool *ConnectionPool, server *ServerConn) *backendConn {
+	return &backendConn{
+		upstream: upstream,
+		pool:     pool,
+		server:   server,
+		conn:     server.conn,
+		txStatus: 'I',
+		key:      server.cancelKey,
+	}
+}
+
+// inTransaction reports whether the backend has an open (or failed)
+// transaction block, going by its last ReadyForQuery
+func (b *backendConn) inTransaction() bool {
+	return b.txStatus == 'T' || b.txStatus == 'E'
+}
+
+// pendingReply is a client message the backend still owes a response to, or a
+// response the proxy writes itself in place of the backend.
+type pendingReply struct {
+	msgType   byte              // frontend message type being answered
+	fake      []byte            // response written by the proxy instead of the backend
+	ready     bool              // the proxy also answers with ReadyForQuery
+	discard   bool              // the response is for the proxy and never reaches the client
+	internal  bool              // the message was added by the proxy; only an error reaches the client
+	release   bool              // the backend goes back to its pool once this is answered
+	statement string            // server statement name a Parse prepares, forgotten if it fails
+	setting   *settingChange    // SET or RESET tracked once the query succeeds
+	settings  map[string]string // settings the backend carries once the query succeeds
+	failed    bool              // the backend answered with an error
+	run       *statementRun     // statements the reply covers, timed for the query statistics
+}
+
+// errBackendReleased stops the goroutine reading from a backend that was
+// reset for its pool
+var errBackendReleased = errors.New("backend released")
+
+func NewSession(request *Request, role UserRole, poolKey PoolKey, settings map[string]string, credential *store.UpstreamCredential, primary *backendConn) *Session {
+	s := &Session{
+		request:    request,
+		role:       role,
+		poolMode:   request.poolMode,
+		poolKey:    poolKey,
+		settings:   settings,
+		credential: credential,
+		txStatus:   'I',
+		statements: make(map[string]*preparedStatement),
+		primary:    primary,
+		current:    primary,
+	}
+
+	s.cond = sync.NewCond(&s.lock)
+
+	return s
+}
+
+// backends returns the backend sessions currently open for the client
+func (s *Session) backends() []*backendConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	backends := make([]*backendConn, 0, 2)
+	for _, backend := range []*backendConn{s.primary, s.replica, s.current} {
+		if backend != nil && !slices.Contains(backends, backend) {
+			backends = append(backends, backend)
+		}
+	}
+
+	return backends
+}
+
+// cancelTarget returns the backend running the session's statements and the
+// key to cancel them with, or nil if no backend is borrowed or it has not sent
+// its key
+func (s *Session) cancelTarget() (*backendConn, cancelKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.current == nil || s.current.key == nil {
+		return nil, cancelKey{}
+	}
+
+	return s.current, *s.current.key
+}
+
+// waitIdle blocks until every reply owed to the client has been written, so
+// that responses from different backends can never interleave.
+func (s *Session) waitIdle() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.replies) > 0 {
+		s.cond.Wait()
+	}
+}
+
+// settingsSnapshot returns a copy of the settings the session applies to
+// every backend it borrows
+func (s *Session) settingsSnapshot() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return maps.Clone(s.settings)
+}
+
+// pin keeps the session on its backend once it has one on the primary
+func (s *Session) pin() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pinned = true
+}
+
+func (s *Session) isPinned() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.pinned
+}
+
+// trackSetting records a SET or RESET that succeeded on backend outside a
+// transaction block. The caller must hold s.lock.
+func (s *Session) trackSetting(backend *backendConn, setting *settingChange) {
+	settings := maps.Clone(s.settings)
+
+	switch {
+	case setting.name == "":
+		clear(settings)
+	case setting.value == "":
+		delete(settings, setting.name)
+	default:
+		settings[setting.name] = setting.value
+	}
+
+	s.settings = settings
+
+	// the backend now carries them too, so it need not be told again
+	backend.server.settings = maps.Clone(settings)
+}
+
+// end closes the client connection once, which stops the frontend goroutine
+func (s *Session) end() {
+	s.closeOnce.Do(func() {
+		_ = s.request.conn.Close()
+	})
+}
+
+// isFake reports whether the proxy answers this reply itself
+func (r *pendingReply) isFake() bool {
+	return r.fake != nil || r.ready
+}
+
+// completes reports whether a backend message of type respType is the last
+// response to a frontend message of type reqType
+func (r *pendingReply) completes(respType byte) bool {
+	switch r.msgType {
+	case 'P':
+		return respType == '1' || respType == 'E'
+	case 'B':
+		return respType == '2' || respType == 'E'
+	case 'C':
+		return respType == '3' || respType == 'E'
+	case 'D':
+		return respType == 'T' || respType == 'n' || respType == 'E'
+	case 'E':
+		return respType == 'C' || respType == 'I' || respType == 's' || respType == 'E'
+	default:
+		// Query, FunctionCall and Sync all end with ReadyForQuery
+		return respType == 'Z'
+	}
+}
+
+// expect queues the replies owed for messages about to be sent to the backend
+// (or answered by the proxy) and writes any proxy answers that are already due.
+func (s *Session) expect(replies ...*pendingReply) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.replies = append(s.replies, replies...)
+
+	return s.writeFakes()
+}
+
+// expectFrom is expect for the messages in data, about to be sent to backend.
+// It returns them as rewritten for the backend's prepared statements, and
+// fails with errBackendReleased once the backend has gone back to its pool.
+func (s *Session) expectFrom(backend *backendConn, data []byte, replies ...*pendingReply) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if backend.released {
+		return nil, errBackendReleased
+	}
+
+	data, replies = s.prepareStatements(backend, data, replies)
+
+	s.replies = append(s.replies, replies...)
+
+	return data, s.writeFakes()
+}
+
+// readReplica returns the replica backend the session's next read would
+// reuse, or nil when it would pick a replica
+func (s *Session) readReplica() *backendConn {
+	if s.poolMode == PoolModeSession {
+		return s.replica
+	}
+
+	if current := s.attached(); current != nil && current.upstream.Role == UpstreamReplica {
+		return current
+	}
+
+	return nil
+}
+
+// attached returns the backend the session has borrowed, or nil
+func (s *Session) attached() *backendConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.current
+}
+
+// forward writes a message from backend to the client and matches it against
+// the oldest pending reply, writing proxy answers queued behind it once it completes.
+func (s *Session) forward(backend *backendConn, msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	msgType := msg[0]
+
+	var head *pendingReply
+	if len(s.replies) > 0 {
+		head = s.replies[0]
+	}
+
+	discard := head != nil && head.discard
+	hidden := discard || (head != nil && head.internal && msgType != 'E')
+
+	switch msgType {
+	case 'Z':
+		if len(msg) > 5 {
+			backend.txStatus = msg[5]
+
+			if !discard {
+				s.txStatus = msg[5]
+			}
+		}
+	case 'S':
+		// the pool hands the session out with its current parameters
+		if keyValue := parseParameterStatus(msg[5:]); len(keyValue) >= 2 {
+			backend.server.params[keyValue[0]] = keyValue[1]
+		}
+	case 'E':
+		if discard {
+			backend.dirty = true
+		}
+
+		if head != nil {
+			head.failed = true
+		}
+	}
+
+	if !hidden {
+		if _, err := s.request.conn.Write(msg); err != nil {
+			return err
+		}
+	}
+
+	if head != nil && head.run != nil && s.queryStats != nil {
+		head.run.observe(s.queryStats, s.username, backend.upstream.Name, msg, s.lastReply)
+	}
+
+	if head == nil || !head.completes(msgType) {
+		return nil
+	}
+
+	s.replies = s.replies[1:]
+	s.lastReply = time.Now()
+
+	if head.setting != nil && msgType == 'Z' && !head.failed {
+		if backend.txStatus == 'I' {
+			s.trackSetting(backend, head.setting)
+		} else {
+			// a SET inside a transaction block may yet be rolled back
+			s.pinned = true
+		}
+	}
+
+	if head.settings != nil && msgType == 'Z' && !head.failed {
+		backend.server.settings = head.settings
+	}
+
+	if msgType == 'E' && head.statement != "" {
+		delete(backend.server.prepared, head.statement)
+	}
+
+	if head.release {
+		// DISCARD ALL also undid the startup parameters and prepared statements
+		backend.server.settings = nil
+		clear(backend.server.prepared)
+		backend.reusable = !backend.dirty && backend.txStatus == 'I'
+		backend.released = true
+		s.cond.Broadcast()
+
+		return errBackendReleased
+	}
+
+	// after an error in an extended-protocol message the backend skips
+	// everything up to the next Sync, so nothing else before it is answered
+	if msgType == 'E' && head.msgType != 'S' {
+		for len(s.replies) > 0 && s.replies[0].msgType != 'S' {
+			if s.replies[0].statement != "" {
+				delete(backend.server.prepared, s.replies[0].statement)
+			}
+
+			s.replies = s.replies[1:]
+		}
+	}
+
+	s.cond.Broadcast()
+
+	if err := s.writeFakes(); err != nil {
+		return err
+	}
+
+	// in transaction pooling the backend goes back to its pool as soon as it
+	// is outside a transaction block and owes the client nothing more
+	if msgType == 'Z' && s.poolMode == PoolModeTransaction && backend.txStatus == 'I' && len(s.replies) == 0 &&
+		!(s.pinned && backend.upstream.Role == UpstreamPrimary) {
+		backend.reusable = !backend.dirty
+		backend.released = true
+
+		if s.current == backend {
+			s.current = nil
+		}
+
+		return errBackendReleased
+	}
+
+	return nil
+}
+
+// writeFakes writes the proxy's own answers sitting at the head of the queue.
+// The caller must hold s.lock.
+func (s *Session) writeFakes() error {
+	for len(s.replies) > 0 && s.replies[0].isFake() {
+		head := s.replies[0]
+		s.replies = s.replies[1:]
+
+		if head.fake != nil {
+			if _, err := s.request.conn.Write(head.fake); err != nil {
+				return err
+			}
+		}
+
+		if head.ready {
+			if _, err := s.request.conn.Write(encodeReadyForQuery(s.txStatus)); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.cond.Broadcast()
+
+	return nil
+}
@@ -16,6 +16,8 @@ CREATE TABLE IF NOT EXISTS health_checks (
 	addr TEXT NOT NULL,
 	healthy INTEGER NOT NULL,
 	lag INTEGER NOT NULL,
+	replication_lag INTEGER,
+	in_recovery INTEGER,
 	state_change INTEGER NOT NULL,
 	created_at DATETIME NOT NULL
 );`
@@ -25,6 +27,7 @@ CREATE TABLE IF NOT EXISTS users (
 	id TEXT PRIMARY KEY,
 	username TEXT NOT NULL UNIQUE,
 	password TEXT NOT NULL,
+	scram_verifier TEXT NOT NULL DEFAULT '',
 	is_admin INTEGER NOT NULL,
 	role TEXT,
 	created_at DATETIME NOT NULL,
@@ -32,6 +35,47 @@ CREATE TABLE IF NOT EXISTS users (
 	deleted_at DATETIME
 );`
 
+const createUpstreamCredentialTable = `
+CREATE TABLE IF NOT EXISTS upstream_credentials (
+	id TEXT PRIMARY KEY,
+	proxy_user TEXT NOT NULL DEFAULT '',
+	proxy_role TEXT NOT NULL DEFAULT '',
+	db_user TEXT NOT NULL,
+	db_password TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS upstream_credentials_proxy_user ON upstream_credentials(proxy_user) WHERE proxy_user != '';
+CREATE UNIQUE INDEX IF NOT EXISTS upstream_credentials_proxy_role ON upstream_credentials(proxy_role) WHERE proxy_user = '';`
+
+const createFirewallRuleTable = `
+CREATE TABLE IF NOT EXISTS firewall_rules (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	proxy_user TEXT NOT NULL DEFAULT '',
+	proxy_role TEXT NOT NULL DEFAULT '',
+	statement_types TEXT NOT NULL DEFAULT '',
+	schemas TEXT NOT NULL DEFAULT '',
+	missing_where BOOLEAN NOT NULL DEFAULT 0,
+	copy_program BOOLEAN NOT NULL DEFAULT 0,
+	window_start TEXT NOT NULL DEFAULT '',
+	window_end TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL
+);`
+
+const createAllowlistTable = `
+CREATE TABLE IF NOT EXISTS allowlist_entries (
+	id TEXT PRIMARY KEY,
+	proxy_user TEXT NOT NULL,
+	fingerprint TEXT NOT NULL,
+	query TEXT NOT NULL,
+	status TEXT NOT NULL,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS allowlist_entries_user_fingerprint ON allowlist_entries(proxy_user, fingerprint);`
+
 const createRequestTable = `
 CREATE TABLE IF NOT EXISTS requests (
 	id TEXT PRIMARY KEY,
@@ -50,5 +94,10 @@ CREATE TABLE IF NOT EXISTS sqls (
     sql TEXT NOT NULL,
     created_at DATETIME NOT NULL,
     completed_at DATETIME,
-    is_read BOOLEAN NOT NULL DEFAULT 0
+    is_read BOOLEAN NOT NULL DEFAULT 0,
+    rejected BOOLEAN NOT NULL DEFAULT 0,
+    hint TEXT NOT NULL DEFAULT '',
+    type TEXT NOT NULL DEFAULT '',
+    tables TEXT NOT NULL DEFAULT '',
+    rule_id TEXT
 );`
@@ -0,0 +1,667 @@
+package sqlparser
+
+import "strings"
+
+// analyzer works out what one statement does from its tokens
+type analyzer struct {
+	tokens    []token
+	statement Statement
+	verb      int             // index of the keyword the statement proper starts with, past any WITH
+	object    int             // index of the last word of the object type of a CREATE, ALTER or DROP
+	kind      string          // that object type, as in TABLE or MATERIALIZED VIEW
+	ctes      map[string]bool // names the WITH clause defines, which are not tables
+	tables    map[Table]bool
+	schemas   map[string]bool
+	writes    bool // something in the statement changes data even if it reads as a query
+}
+
+func analyze(tokens []token) Statement {
+	a := &analyzer{
+		tokens:  tokens,
+		object:  -1,
+		ctes:    make(map[string]bool),
+		tables:  make(map[Table]bool),
+		schemas: make(map[string]bool),
+	}
+
+	// (SELECT ...) UNION (SELECT ...)
+	start := 0
+	for a.at(start).isPunct("(") {
+		start++
+	}
+
+	a.verb = a.mainVerb(start)
+
+	verb := a.at(a.verb)
+	if verb.kind != tokenIdent {
+		return a.statement
+	}
+
+	word := strings.ToUpper(verb.value)
+	a.statement.Type = a.statementType(word)
+
+	if word == "EXPLAIN" {
+		return a.explain()
+	}
+
+	a.transaction(word)
+	a.sessionState(word)
+	a.statementRelations(word)
+	a.scan()
+
+	switch {
+	case a.writes:
+	case readVerbs[word]:
+		a.statement.Class = Read
+	case word == "COPY":
+		a.statement.Class = a.copyClass()
+	case word == "SET" && a.replicationRoleReplica():
+		a.statement.Class = Read
+	}
+
+	a.statement.Modifies = a.modifies(word)
+
+	return a.statement
+}
+
+// modifies tells a statement that changes something from one that reads or
+// only controls the session and its transactions, which need the primary
+// all the same
+func (a *analyzer) modifies(word string) bool {
+	switch {
+	case a.statement.Class == Read:
+		return false
+	case a.writes:
+		return true
+	case word == "PREPARE":
+		// PREPARE name [(types)] AS statement; PREPARE TRANSACTION has no AS
+		for i := a.verb + 1; i < len(a.tokens); i++ {
+			if a.tokens[i].is("AS") {
+				return analyze(a.tokens[i+1:]).Modifies
+			}
+		}
+
+		return true
+	case word == "COMMIT" || word == "ROLLBACK":
+		// COMMIT PREPARED finishes a transaction that may have written
+		return a.at(a.verb + 1).is("PREPARED")
+	}
+
+	return !controlVerbs[word]
+}
+
+// at returns tokens[i], or a token that matches nothing past either end
+func (a *analyzer) at(i int) token {
+	if i < 0 || i >= len(a.tokens) {
+		return token{kind: tokenPunct}
+	}
+
+	return a.tokens[i]
+}
+
+// closing returns the index of the parenthesis closing the one at tokens[i]
+func (a *analyzer) closing(i int) int {
+	depth := 0
+
+	for ; i < len(a.tokens); i++ {
+		switch {
+		case a.tokens[i].isPunct("("):
+			depth++
+		case a.tokens[i].isPunct(")"):
+			depth--
+
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return len(a.tokens)
+}
+
+// skipWords returns the index of the first token from i on that is none of
+// the keywords
+func (a *analyzer) skipWords(i int, keywords ...string) int {
+	for {
+		skipped := false
+
+		for _, keyword := range keywords {
+			if a.at(i).is(keyword) {
+				i++
+				skipped = true
+			}
+		}
+
+		if !skipped {
+			return i
+		}
+	}
+}
+
+// mainVerb returns the index of the keyword the statement proper starts
+// with. A WITH clause before it is skipped, noting the names it defines.
+func (a *analyzer) mainVerb(start int) int {
+	if !a.at(start).is("WITH") {
+		return start
+	}
+
+	for i := start + 1; i < len(a.tokens); i++ {
+		t := a.tokens[i]
+
+		switch {
+		case t.isPunct("("):
+			i = a.closing(i)
+		case t.kind == tokenIdent && queryVerbs[strings.ToUpper(t.value)] && !t.is("WITH"):
+			return i
+		case t.isName():
+			// name AS (...) or name (columns) AS (...)
+			next := i + 1
+			if a.at(next).isPunct("(") {
+				next = a.closing(next) + 1
+			}
+
+			if a.at(next).is("AS") {
+				a.ctes[t.value] = true
+			}
+		}
+	}
+
+	return start
+}
+
+// statementType names the command that starts with word
+func (a *analyzer) statementType(word string) string {
+	switch word {
+	case "CREATE", "ALTER", "DROP":
+		if object := a.objectType(a.verb + 1); object != "" {
+			return word + " " + object
+		}
+	case "START":
+		if a.at(a.verb + 1).is("TRANSACTION") {
+			return "START TRANSACTION"
+		}
+	}
+
+	return word
+}
+
+// objectType returns the kind of object a CREATE, ALTER or DROP starting at
+// tokens[i] is about, as in TABLE or MATERIALIZED VIEW
+func (a *analyzer) objectType(i int) string {
+	for ; a.at(i).kind == tokenIdent; i++ {
+		word := strings.ToUpper(a.at(i).value)
+
+		if next := a.at(i + 1); next.kind == tokenIdent && compoundObjects[word+" "+strings.ToUpper(next.value)] {
+			a.object, a.kind = i+1, word+" "+strings.ToUpper(next.value)
+			return a.kind
+		}
+
+		if !objectModifiers[word] {
+			a.object, a.kind = i, word
+			return a.kind
+		}
+	}
+
+	return ""
+}
+
+// transaction notes whether the statement begins or ends a transaction block
+func (a *analyzer) transaction(word string) {
+	next := a.at(a.verb + 1)
+
+	switch word {
+	case "BEGIN":
+		a.statement.BeginsTransaction = true
+	case "START":
+		a.statement.BeginsTransaction = next.is("TRANSACTION")
+	case "PREPARE":
+		a.statement.EndsTransaction = next.is("TRANSACTION")
+	case "COMMIT", "END", "ABORT", "ROLLBACK":
+		// COMMIT PREPARED and ROLLBACK PREPARED finish a prepared
+		// transaction outside any block, ROLLBACK TO a savepoint stays in it
+		if next.is("PREPARED") {
+			return
+		}
+
+		for _, t := range a.tokens[a.verb:] {
+			if t.is("TO") {
+				return
+			}
+		}
+
+		a.statement.EndsTransaction = true
+
+		n := len(a.tokens)
+		a.statement.BeginsTransaction = a.at(n-1).is("CHAIN") && a.at(n-2).is("AND")
+	}
+}
+
+// sessionState notes whether the statement leaves state behind in the
+// backend session past the end of its transaction
+func (a *analyzer) sessionState(word string) {
+	next := a.at(a.verb + 1)
+
+	switch word {
+	case "SET":
+		// SET LOCAL and the settings of the transaction itself end with it
+		a.statement.SessionState = !next.is("LOCAL") && !next.is("TRANSACTION") && !next.is("CONSTRAINTS")
+	case "RESET", "LISTEN", "LOAD":
+		a.statement.SessionState = true
+	case "PREPARE":
+		a.statement.SessionState = !next.is("TRANSACTION")
+	case "DECLARE":
+		// a cursor WITH HOLD outlives the transaction that declared it
+		for i := a.verb + 1; i < len(a.tokens) && !a.tokens[i].is("FOR"); i++ {
+			if a.tokens[i].is("WITH") && a.at(i+1).is("HOLD") {
+				a.statement.SessionState = true
+			}
+		}
+	case "CREATE":
+		for i := a.verb + 1; i < a.object; i++ {
+			if a.tokens[i].is("TEMP") || a.tokens[i].is("TEMPORARY") {
+				a.statement.SessionState = true
+			}
+		}
+	}
+}
+
+// statementRelations notes the relations statements name right after their
+// verb, without a keyword of their own
+func (a *analyzer) statementRelations(word string) {
+	i := a.verb + 1
+
+	switch word {
+	case "COPY":
+		if a.at(i).isName() {
+			a.relation(i, false)
+		}
+
+		a.statement.CopyProgram = a.at(a.copyDirection() + 1).is("PROGRAM")
+	case "LOCK", "TRUNCATE":
+		if !a.at(i).is("TABLE") {
+			a.relations(i, false)
+		}
+	case "VACUUM", "ANALYZE", "ANALYSE":
+		if a.at(i).isPunct("(") {
+			i = a.closing(i) + 1
+		}
+
+		a.relations(a.skipWords(i, "FULL", "FREEZE", "VERBOSE", "ANALYZE", "ANALYSE"), false)
+	}
+}
+
+// queryContext is a query scan is inside of: the statement itself or a
+// parenthesised subquery or expression
+type queryContext struct {
+	verb     string // the keyword the query starts with; empty for an expression
+	filtered bool   // a WHERE clause was seen at its level
+}
+
+// scan walks the statement for the clauses that name relations and schemas
+// and for what makes a query write. Each parenthesised subquery is scanned
+// with the verb it starts with, other parentheses hold expressions.
+func (a *analyzer) scan() {
+	contexts := []queryContext{{verb: strings.ToUpper(a.at(a.verb).value)}}
+
+	for i, t := range a.tokens {
+		context := contexts[len(contexts)-1].verb
+
+		if t.kind == tokenIdent && a.at(i+1).isPunct("(") {
+			a.call(strings.ToUpper(t.value))
+		}
+
+		switch {
+		case t.isPunct("("):
+			verb := ""
+			if next := a.at(i + 1); next.kind == tokenIdent && queryVerbs[strings.ToUpper(next.value)] {
+				verb = strings.ToUpper(next.value)
+			}
+
+			// a data-modifying WITH query
+			if modifyingVerbs[verb] {
+				a.writes = true
+			}
+
+			contexts = append(contexts, queryContext{verb: verb})
+			continue
+		case t.isPunct(")"):
+			if len(contexts) > 1 {
+				a.closeContext(contexts[len(contexts)-1])
+				contexts = contexts[:len(contexts)-1]
+			}
+
+			continue
+		case t.kind != tokenIdent || a.at(i-1).isPunct("."):
+			continue
+		}
+
+		topLevel := len(contexts) == 1
+		startsQuery := i == a.verb || a.at(i-1).isPunct("(")
+
+		switch word := strings.ToUpper(t.value); word {
+		case "FROM":
+			// a IS DISTINCT FROM b compares
+			distinct := a.at(i-1).is("DISTINCT") && (a.at(i-2).is("IS") || a.at(i-2).is("NOT"))
+			if fromVerbs[context] && !distinct {
+				a.relations(i+1, true)
+			}
+		case "JOIN":
+			if fromVerbs[context] {
+				a.relation(i+1, true)
+			}
+		case "USING":
+			if context == "DELETE" || context == "MERGE" {
+				a.relations(i+1, true)
+			}
+		case "INTO":
+			switch {
+			case a.at(i-1).is("INSERT") || a.at(i-1).is("MERGE"):
+				a.relation(i+1, false)
+			case context == "SELECT":
+				// SELECT ... INTO creates a table
+				a.writes = true
+
+				if a.at(i+1).is("TEMP") || a.at(i+1).is("TEMPORARY") {
+					a.statement.SessionState = true
+				}
+
+				a.relation(a.skipWords(i+1, "TEMP", "TEMPORARY", "UNLOGGED", "TABLE"), false)
+			}
+		case "UPDATE":
+			if startsQuery {
+				a.relation(a.skipWords(i+1, "ONLY"), false)
+			}
+		case "TABLE":
+			if startsQuery {
+				a.relation(a.skipWords(i+1, "ONLY"), false)
+			} else {
+				a.relations(a.skipWords(i+1, "IF", "NOT", "EXISTS"), false)
+			}
+		case "ON":
+			if !topLevel || !onTableTypes[a.statement.Type] {
+				break
+			}
+
+			// GRANT ... ON TABLE and ON SCHEMA are picked up as such
+			if next := a.at(i + 1); next.kind == tokenIdent && grantObjects[strings.ToUpper(next.value)] {
+				break
+			}
+
+			a.relations(i+1, false)
+		case "WHERE":
+			contexts[len(contexts)-1].filtered = true
+		case "REFERENCES":
+			a.relation(i+1, false)
+		case "SCHEMA":
+			a.schemaNames(a.skipWords(i+1, "IF", "NOT", "EXISTS"))
+		case "FOR":
+			// row locks only work on the primary
+			next := a.at(i + 1)
+			if next.is("UPDATE") || next.is("SHARE") || next.is("NO") || (next.is("KEY") && a.at(i+2).is("SHARE")) {
+				a.writes = true
+			}
+		}
+
+		// the names after CREATE VIEW, DROP SEQUENCE and the like; the
+		// ones after TABLE are picked up above
+		if i == a.object && relationObjects[a.kind] && !t.is("TABLE") {
+			a.relations(a.skipWords(i+1, "IF", "NOT", "EXISTS"), false)
+		}
+	}
+
+	for _, context := range contexts {
+		a.closeContext(context)
+	}
+}
+
+// call notes a call of the function named name, which may change the
+// database or the backend session
+func (a *analyzer) call(name string) {
+	if writeFunctions[name] {
+		a.writes = true
+	}
+
+	if sessionFunctions[name] {
+		a.statement.SessionState = true
+	}
+}
+
+// closeContext notes an UPDATE or DELETE that ended without a WHERE clause
+func (a *analyzer) closeContext(context queryContext) {
+	if (context.verb == "UPDATE" || context.verb == "DELETE") && !context.filtered {
+		a.statement.Unfiltered = true
+	}
+}
+
+// relations notes the comma-separated relations starting at tokens[i]. In a
+// FROM list they may be subqueries or functions, and carry aliases.
+func (a *analyzer) relations(i int, fromList bool) {
+	for {
+		i = a.relation(i, fromList)
+		if i < 0 || !a.at(i).isPunct(",") {
+			return
+		}
+
+		i++
+	}
+}
+
+// relation notes the relation named at tokens[i] and returns the index past
+// it and its alias, or -1 when no relation is named there
+func (a *analyzer) relation(i int, fromList bool) int {
+	i = a.skipWords(i, "ONLY", "LATERAL")
+
+	switch t := a.at(i); {
+	case fromList && t.isPunct("("):
+		i = a.closing(i) + 1
+	case t.is("ROWS") && a.at(i+1).is("FROM"):
+		// ROWS FROM (functions)
+		i = a.closing(i+2) + 1
+	case t.isName():
+		table, next := a.qualifiedName(i)
+
+		if fromList && a.at(next).isPunct("(") {
+			// a set-returning function
+			next = a.closing(next) + 1
+		} else {
+			a.addTable(table)
+		}
+
+		i = next
+
+		// TRUNCATE t * includes the descendants
+		if a.at(i).kind == tokenOperator && a.at(i).value == "*" {
+			i++
+		}
+	default:
+		return -1
+	}
+
+	if !fromList {
+		return i
+	}
+
+	// [AS] alias [(columns)] [TABLESAMPLE method (arguments) [REPEATABLE (seed)]]
+	if a.at(i).is("AS") {
+		i++
+	}
+
+	if a.at(i).isName() {
+		i++
+
+		if a.at(i).isPunct("(") {
+			i = a.closing(i) + 1
+		}
+	}
+
+	if a.at(i).is("TABLESAMPLE") {
+		i = a.closing(i+2) + 1
+
+		if a.at(i).is("REPEATABLE") {
+			i = a.closing(i+1) + 1
+		}
+	}
+
+	return i
+}
+
+// qualifiedName reads the name at tokens[i], which may be qualified with a
+// schema and a database, and returns it with the index past it
+func (a *analyzer) qualifiedName(i int) (Table, int) {
+	parts := []string{a.at(i).value}
+	i++
+
+	for a.at(i).isPunct(".") {
+		next := a.at(i + 1)
+		if next.kind != tokenIdent && next.kind != tokenQuotedIdent {
+			break
+		}
+
+		parts = append(parts, next.value)
+		i += 2
+	}
+
+	table := Table{Name: parts[len(parts)-1]}
+	if len(parts) > 1 {
+		table.Schema = parts[len(parts)-2]
+	}
+
+	return table, i
+}
+
+// schemaNames notes the comma-separated schemas starting at tokens[i]
+func (a *analyzer) schemaNames(i int) {
+	// CREATE SCHEMA AUTHORIZATION role names the schema after the role
+	if a.at(i).is("AUTHORIZATION") {
+		return
+	}
+
+	for a.at(i).isName() {
+		a.addSchema(a.at(i).value)
+
+		if !a.at(i + 1).isPunct(",") {
+			return
+		}
+
+		i += 2
+	}
+}
+
+func (a *analyzer) addTable(table Table) {
+	// a WITH query, not a table
+	if table.Schema == "" && a.ctes[table.Name] {
+		return
+	}
+
+	if table.Schema != "" {
+		a.addSchema(table.Schema)
+	}
+
+	if !a.tables[table] {
+		a.tables[table] = true
+		a.statement.Tables = append(a.statement.Tables, table)
+	}
+}
+
+func (a *analyzer) addSchema(schema string) {
+	if !a.schemas[schema] {
+		a.schemas[schema] = true
+		a.statement.Schemas = append(a.statement.Schemas, schema)
+	}
+}
+
+// explain analyses the statement EXPLAIN shows the plan of. Only EXPLAIN
+// ANALYZE runs it, so only then does it need the primary for a write.
+func (a *analyzer) explain() Statement {
+	var (
+		i       = a.verb + 1
+		analyse bool
+	)
+
+	for {
+		t := a.at(i)
+
+		if t.isPunct("(") {
+			end := a.closing(i)
+
+			for j := i + 1; j < end; j++ {
+				if a.at(j).is("ANALYZE") || a.at(j).is("ANALYSE") {
+					next := a.at(j + 1)
+					analyse = !next.is("FALSE") && !next.is("OFF") && next.value != "0"
+				}
+			}
+
+			i = end + 1
+			continue
+		}
+
+		if t.is("ANALYZE") || t.is("ANALYSE") {
+			analyse = true
+		} else if !t.is("VERBOSE") {
+			break
+		}
+
+		i++
+	}
+
+	explained := analyze(a.tokens[i:])
+
+	a.statement.Tables = explained.Tables
+	a.statement.Schemas = explained.Schemas
+	a.statement.Class = Read
+
+	if analyse {
+		a.statement.Unfiltered = explained.Unfiltered
+		a.statement.Modifies = explained.Modifies
+
+		if explained.Class == Write {
+			a.statement.Class = Write
+		}
+	}
+
+	return a.statement
+}
+
+// copyClass tells COPY ... TO, which reads, from COPY ... FROM, which writes.
+// COPY ... TO PROGRAM runs a command on the server, which only the primary
+// is trusted with.
+func (a *analyzer) copyClass() Class {
+	if a.at(a.copyDirection()).is("TO") && !a.statement.CopyProgram {
+		return Read
+	}
+
+	return Write
+}
+
+// copyDirection returns the index of the TO or FROM of a COPY
+func (a *analyzer) copyDirection() int {
+	i := a.verb + 1
+	if a.at(i).isPunct("(") {
+		return a.closing(i) + 1
+	}
+
+	_, i = a.qualifiedName(i)
+
+	if a.at(i).isPunct("(") {
+		i = a.closing(i) + 1
+	}
+
+	return i
+}
+
+// replicationRoleReplica reports whether the statement is SET
+// session_replication_role = replica, which replicas accept
+func (a *analyzer) replicationRoleReplica() bool {
+	i := a.skipWords(a.verb+1, "SESSION")
+	if !a.at(i).is("SESSION_REPLICATION_ROLE") {
+		return false
+	}
+
+	if op := a.at(i + 1); !op.is("TO") && !(op.kind == tokenOperator && op.value == "=") {
+		return false
+	}
+
+	value := strings.Trim(a.at(i+2).value, "'")
+
+	return strings.EqualFold(value, "replica") && len(a.tokens) == i+3
+}
@@ -0,0 +1,159 @@
+package sqlparser
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// normalize writes out a statement with its constants and parameters
+// replaced by $1, $2, ... in order, so that statements differing only in
+// their values, or in the way their values reach the server, read the same.
+// Identifiers are folded, comments and whitespace dropped, and the constants
+// of an IN (...) or ARRAY[...] list stand for one.
+func normalize(tokens []token) string {
+	var (
+		out  strings.Builder
+		last token
+		n    int
+	)
+
+	for _, t := range squashLists(constants(tokens)) {
+		text := t.value
+
+		switch t.kind {
+		case tokenParam:
+			n++
+			text = fmt.Sprintf("$%d", n)
+		case tokenQuotedIdent:
+			text = `"` + strings.ReplaceAll(t.value, `"`, `""`) + `"`
+		}
+
+		if out.Len() > 0 && spaceBetween(last, t) {
+			out.WriteByte(' ')
+		}
+
+		out.WriteString(text)
+		last = t
+	}
+
+	return out.String()
+}
+
+// constants turns each constant and parameter into a bare parameter token. A
+// minus sign where no operand comes before it belongs to the number.
+func constants(tokens []token) []token {
+	result := make([]token, 0, len(tokens))
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+
+		if t.kind == tokenOperator && t.value == "-" && i+1 < len(tokens) && tokens[i+1].kind == tokenNumber &&
+			(len(result) == 0 || !endsOperand(result[len(result)-1])) {
+			i++
+			t = tokens[i]
+		}
+
+		switch t.kind {
+		case tokenString, tokenNumber, tokenParam:
+			result = append(result, token{kind: tokenParam})
+		default:
+			result = append(result, t)
+		}
+	}
+
+	return result
+}
+
+// squashLists keeps the first of the constants standing alone in an IN
+// (...) or ARRAY[...] list
+func squashLists(tokens []token) []token {
+	var (
+		result []token
+		lists  []bool // open parentheses and brackets, true for lists of values
+	)
+
+	at := func(i int) token {
+		if i < 0 || i >= len(result) {
+			return token{kind: tokenPunct}
+		}
+
+		return result[i]
+	}
+
+	for i, t := range tokens {
+		switch {
+		case t.isPunct("(") || t.isPunct("["):
+			previous := at(len(result) - 1)
+			lists = append(lists, previous.is("IN") || previous.is("ARRAY"))
+		case t.isPunct(")") || t.isPunct("]"):
+			if len(lists) > 0 {
+				lists = lists[:len(lists)-1]
+			}
+		case t.kind == tokenParam && len(lists) > 0 && lists[len(lists)-1]:
+			next := token{kind: tokenPunct}
+			if i+1 < len(tokens) {
+				next = tokens[i+1]
+			}
+
+			// an item of its own right after another one
+			k := len(result)
+			first := at(k - 3)
+			if at(k-1).isPunct(",") && at(k-2).kind == tokenParam &&
+				(first.isPunct("(") || first.isPunct("[") || first.isPunct(",")) &&
+				(next.isPunct(",") || next.isPunct(")") || next.isPunct("]")) {
+				result = result[:k-1]
+				continue
+			}
+		}
+
+		result = append(result, t)
+	}
+
+	return result
+}
+
+// spaceBetween tells whether the normalized text puts a space between two
+// tokens
+func spaceBetween(before, after token) bool {
+	switch {
+	case before.isPunct("(") || before.isPunct("[") || before.isPunct(".") || before.isPunct("::"):
+		return false
+	case after.isPunct(",") || after.isPunct(")") || after.isPunct("]") || after.isPunct(".") || after.isPunct("::") || after.isPunct(";"):
+		return false
+	case after.isPunct("["):
+		return false
+	case after.isPunct("("):
+		// a function call or a column list after a name
+		if before.is("VALUES") {
+			return true
+		}
+
+		return !before.isName() && !before.is("ANY") && !before.is("ALL") && !before.is("SOME")
+	}
+
+	return true
+}
+
+// endsOperand reports whether an operand can end with t, so that a minus
+// sign after it subtracts
+func endsOperand(t token) bool {
+	switch t.kind {
+	case tokenQuotedIdent, tokenString, tokenNumber, tokenParam:
+		return true
+	case tokenIdent:
+		return t.isName()
+	case tokenPunct:
+		return t.isPunct(")") || t.isPunct("]")
+	}
+
+	return false
+}
+
+// fingerprint hashes a normalized statement
+func fingerprint(normalized string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(normalized))
+
+	return fmt.Sprintf("%016x", h.Sum64())
+}
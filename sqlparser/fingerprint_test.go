@@ -0,0 +1,57 @@
+package sqlparser
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT * FROM users WHERE id = 5", "select * from users where id = $1"},
+		{"select *  from USERS where id=$7 -- comment", "select * from users where id = $1"},
+		{"SELECT * FROM users WHERE id = -5", "select * from users where id = $1"},
+		{"SELECT a - 1, b-1, x * -2 FROM t", "select a - $1, b - $2, x * $3 from t"},
+		{"SELECT * FROM t WHERE id IN (1, 2, 3)", "select * from t where id in ($1)"},
+		{"SELECT * FROM t WHERE id IN ($1,$2)", "select * from t where id in ($1)"},
+		{"SELECT * FROM t WHERE id IN (1+2, 3)", "select * from t where id in ($1 + $2, $3)"},
+		{"SELECT * FROM t WHERE id = ANY(ARRAY[1,2,3])", "select * from t where id = any(array[$1])"},
+		{"INSERT INTO t (a, b) VALUES (1, 'x')", "insert into t(a, b) values ($1, $2)"},
+		{`SELECT "Col", count(*)::int FROM s."T" WHERE e = E'a\'b'`, `select "Col", count(*)::int from s."T" where e = $1`},
+		{"SELECT f(1, 2), g (3)", "select f($1, $2), g($3)"},
+		{"UPDATE t SET a = a + 1 WHERE b = true", "update t set a = a + $1 where b = true"},
+	}
+
+	for _, test := range tests {
+		statements, err := Parse(test.query)
+		if err != nil || len(statements) != 1 {
+			t.Errorf("Parse(%q) = %d statements, %v", test.query, len(statements), err)
+			continue
+		}
+
+		if got := statements[0].Normalized; got != test.want {
+			t.Errorf("normalized %q = %q, want %q", test.query, got, test.want)
+		}
+
+		if got, want := statements[0].Fingerprint, fingerprint(test.want); got != want {
+			t.Errorf("fingerprint of %q = %s, want %s", test.query, got, want)
+		}
+	}
+}
+
+func TestFingerprintDiffers(t *testing.T) {
+	tests := [][2]string{
+		{"SELECT * FROM users WHERE id = 1", "SELECT * FROM orders WHERE id = 1"},
+		{"SELECT a FROM t", "SELECT b FROM t"},
+		{"SELECT * FROM t WHERE a = 1", "SELECT * FROM t WHERE a = 1 AND b = 2"},
+		{`SELECT * FROM "T"`, "SELECT * FROM t"},
+	}
+
+	for _, test := range tests {
+		first, _ := Parse(test[0])
+		second, _ := Parse(test[1])
+
+		if first[0].Fingerprint == second[0].Fingerprint {
+			t.Errorf("%q and %q share fingerprint %s", test[0], test[1], first[0].Fingerprint)
+		}
+	}
+}
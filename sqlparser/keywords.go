@@ -0,0 +1,87 @@
+package sqlparser
+
+// reserved holds the keywords that cannot name a relation or stand for an
+// alias without quoting: PostgreSQL's reserved keywords and the ones it only
+// allows as function or type names
+var reserved = setOf(
+	"ALL", "ANALYSE", "ANALYZE", "AND", "ANY", "ARRAY", "AS", "ASC", "ASYMMETRIC",
+	"AUTHORIZATION", "BINARY", "BOTH", "CASE", "CAST", "CHECK", "COLLATE", "COLLATION",
+	"COLUMN", "CONCURRENTLY", "CONSTRAINT", "CREATE", "CROSS", "CURRENT_CATALOG",
+	"CURRENT_DATE", "CURRENT_ROLE", "CURRENT_SCHEMA", "CURRENT_TIME", "CURRENT_TIMESTAMP",
+	"CURRENT_USER", "DEFAULT", "DEFERRABLE", "DESC", "DISTINCT", "DO", "ELSE", "END",
+	"EXCEPT", "FALSE", "FETCH", "FOR", "FOREIGN", "FREEZE", "FROM", "FULL", "GRANT",
+	"GROUP", "HAVING", "ILIKE", "IN", "INITIALLY", "INNER", "INTERSECT", "INTO", "IS",
+	"ISNULL", "JOIN", "LATERAL", "LEADING", "LEFT", "LIKE", "LIMIT", "LOCALTIME",
+	"LOCALTIMESTAMP", "NATURAL", "NOT", "NOTNULL", "NULL", "OFFSET", "ON", "ONLY", "OR",
+	"ORDER", "OUTER", "OVERLAPS", "PLACING", "PRIMARY", "REFERENCES", "RETURNING",
+	"RIGHT", "SELECT", "SESSION_USER", "SIMILAR", "SOME", "SYMMETRIC", "SYSTEM_USER",
+	"TABLE", "TABLESAMPLE", "THEN", "TO", "TRAILING", "TRUE", "UNION", "UNIQUE", "USER",
+	"USING", "VARIADIC", "VERBOSE", "WHEN", "WHERE", "WINDOW", "WITH",
+)
+
+// queryVerbs start the statements a parenthesised subquery can hold
+var queryVerbs = setOf("SELECT", "WITH", "VALUES", "TABLE", "INSERT", "UPDATE", "DELETE", "MERGE")
+
+// modifyingVerbs start the statements that change data; a subquery
+// starting with one is a data-modifying CTE
+var modifyingVerbs = setOf("INSERT", "UPDATE", "DELETE", "MERGE")
+
+// readVerbs start the statements a replica can run
+var readVerbs = setOf("SELECT", "VALUES", "TABLE", "SHOW")
+
+// controlVerbs start the statements that control the session, its
+// transactions and cursors without changing any data
+var controlVerbs = setOf("BEGIN", "START", "COMMIT", "END", "ABORT", "ROLLBACK", "SAVEPOINT", "RELEASE",
+	"SET", "RESET", "SHOW", "FETCH", "MOVE", "CLOSE", "DISCARD", "DEALLOCATE", "LISTEN", "UNLISTEN", "DECLARE")
+
+// fromVerbs start the statements whose FROM clauses name relations. In the
+// others FROM names a role, a cursor or a file.
+var fromVerbs = setOf("SELECT", "WITH", "VALUES", "TABLE", "INSERT", "UPDATE", "DELETE", "MERGE",
+	"CREATE", "EXPLAIN", "DECLARE", "PREPARE")
+
+// onTableTypes are the statements whose ON clause names the relation they
+// apply to
+var onTableTypes = setOf("CREATE INDEX", "CREATE TRIGGER", "CREATE POLICY", "ALTER POLICY",
+	"ALTER TRIGGER", "DROP TRIGGER", "DROP POLICY", "DROP RULE", "GRANT", "REVOKE")
+
+// grantObjects are the kinds of object a GRANT or REVOKE names after ON
+// other than tables
+var grantObjects = setOf("TABLE", "SCHEMA", "ALL", "SEQUENCE", "FUNCTION", "PROCEDURE", "ROUTINE",
+	"DATABASE", "DOMAIN", "FOREIGN", "LANGUAGE", "LARGE", "PARAMETER", "TABLESPACE", "TYPE")
+
+// relationObjects are the relations other than tables a CREATE, ALTER or
+// DROP may name
+var relationObjects = setOf("VIEW", "MATERIALIZED VIEW", "SEQUENCE")
+
+// objectModifiers come between CREATE and the kind of object created
+var objectModifiers = setOf("OR", "REPLACE", "TEMP", "TEMPORARY", "GLOBAL", "LOCAL", "UNLOGGED",
+	"UNIQUE", "RECURSIVE", "TRUSTED", "PROCEDURAL", "DEFAULT", "CONSTRAINT")
+
+// compoundObjects are the kinds of object named with two words
+var compoundObjects = setOf("MATERIALIZED VIEW", "FOREIGN TABLE", "FOREIGN DATA", "EVENT TRIGGER",
+	"ACCESS METHOD", "TEXT SEARCH", "USER MAPPING", "OPERATOR CLASS", "OPERATOR FAMILY", "DEFAULT PRIVILEGES")
+
+// writeFunctions change the database, or take locks, notify listeners or
+// act on the server, even when called from a SELECT
+var writeFunctions = setOf("NEXTVAL", "SETVAL",
+	"PG_ADVISORY_LOCK", "PG_ADVISORY_LOCK_SHARED", "PG_TRY_ADVISORY_LOCK", "PG_TRY_ADVISORY_LOCK_SHARED",
+	"PG_ADVISORY_XACT_LOCK", "PG_ADVISORY_XACT_LOCK_SHARED", "PG_TRY_ADVISORY_XACT_LOCK",
+	"PG_TRY_ADVISORY_XACT_LOCK_SHARED", "PG_ADVISORY_UNLOCK", "PG_ADVISORY_UNLOCK_SHARED",
+	"PG_ADVISORY_UNLOCK_ALL", "PG_NOTIFY", "TXID_CURRENT", "PG_CURRENT_XACT_ID",
+	"LO_CREAT", "LO_CREATE", "LO_IMPORT", "LO_EXPORT", "LO_UNLINK", "LO_PUT", "LO_FROM_BYTEA",
+	"PG_CANCEL_BACKEND", "PG_TERMINATE_BACKEND", "PG_RELOAD_CONF", "PG_ROTATE_LOGFILE",
+	"PG_SWITCH_WAL", "PG_CREATE_RESTORE_POINT", "PG_CREATE_PHYSICAL_REPLICATION_SLOT",
+	"PG_CREATE_LOGICAL_REPLICATION_SLOT", "PG_DROP_REPLICATION_SLOT", "DBLINK_EXEC")
+
+// sessionFunctions leave state behind in the backend session
+var sessionFunctions = setOf("PG_ADVISORY_LOCK", "PG_ADVISORY_LOCK_SHARED", "PG_TRY_ADVISORY_LOCK",
+	"PG_TRY_ADVISORY_LOCK_SHARED", "SET_CONFIG")
+
+func setOf(words ...string) map[string]bool {
+	set := make(map[string]bool, len(words))
+	for _, word := range words {
+		set[word] = true
+	}
+
+	return set
+}
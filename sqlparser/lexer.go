@@ -0,0 +1,311 @@
+package sqlparser
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenIdent       tokenKind = iota // keyword or unquoted identifier
+	tokenQuotedIdent                  // "identifier"
+	tokenString                       // any string constant, dollar-quoted ones included
+	tokenNumber
+	tokenParam // $1
+	tokenPunct // ( ) [ ] , ; . : and ::
+	tokenOperator
+)
+
+// token is one lexical element of a query. Comments and whitespace are not
+// tokens.
+type token struct {
+	kind  tokenKind
+	value string // identifiers folded to lower case, quoted ones unescaped; the source text otherwise
+	pos   int    // offset of the token in the query
+	end   int    // offset just past the token
+}
+
+// is reports whether the token is the unquoted keyword, given in upper case
+func (t token) is(keyword string) bool {
+	return t.kind == tokenIdent && strings.EqualFold(t.value, keyword)
+}
+
+// isPunct reports whether the token is the punctuation mark
+func (t token) isPunct(mark string) bool {
+	return t.kind == tokenPunct && t.value == mark
+}
+
+// isName reports whether the token can name a relation or a schema
+func (t token) isName() bool {
+	return t.kind == tokenQuotedIdent || (t.kind == tokenIdent && !reserved[strings.ToUpper(t.value)])
+}
+
+const operatorChars = "+-*/<>=~!@#%^&|`?"
+
+// lex splits query into tokens the way the PostgreSQL scanner does, with
+// standard_conforming_strings on. It fails on a string, quoted identifier
+// or comment that is never closed.
+func lex(query string) ([]token, error) {
+	var (
+		tokens []token
+		i      int
+	)
+
+	for i < len(query) {
+		c := query[i]
+		start := i
+
+		switch {
+		case isSpace(c):
+			i++
+			continue
+		case strings.HasPrefix(query[i:], "--"):
+			// the server's scanner ends the comment at either line break
+			end := strings.IndexAny(query[i:], "\n\r")
+			if end < 0 {
+				return tokens, nil
+			}
+
+			i += end + 1
+			continue
+		case strings.HasPrefix(query[i:], "/*"):
+			end, err := skipBlockComment(query, i)
+			if err != nil {
+				return nil, err
+			}
+
+			i = end
+			continue
+		case c == '\'':
+			end, err := skipString(query, i, false)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{kind: tokenString, value: query[start:end], pos: start, end: end})
+			i = end
+		case (c == 'e' || c == 'E') && i+1 < len(query) && query[i+1] == '\'':
+			end, err := skipString(query, i+1, true)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{kind: tokenString, value: query[start:end], pos: start, end: end})
+			i = end
+		case strings.ContainsRune("bBxXnN", rune(c)) && i+1 < len(query) && query[i+1] == '\'':
+			end, err := skipString(query, i+1, false)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{kind: tokenString, value: query[start:end], pos: start, end: end})
+			i = end
+		case (c == 'u' || c == 'U') && strings.HasPrefix(query[i+1:], "&'"):
+			end, err := skipString(query, i+2, false)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{kind: tokenString, value: query[start:end], pos: start, end: end})
+			i = end
+		case (c == 'u' || c == 'U') && strings.HasPrefix(query[i+1:], `&"`):
+			value, end, err := quotedIdent(query, i+2)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{kind: tokenQuotedIdent, value: value, pos: start, end: end})
+			i = end
+		case c == '"':
+			value, end, err := quotedIdent(query, i)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{kind: tokenQuotedIdent, value: value, pos: start, end: end})
+			i = end
+		case c == '$' && i+1 < len(query) && isDigit(query[i+1]):
+			i++
+			for i < len(query) && isDigit(query[i]) {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenParam, value: query[start:i], pos: start, end: i})
+		case c == '$':
+			tag, ok := dollarTag(query, i)
+			if !ok {
+				i++
+				tokens = append(tokens, token{kind: tokenOperator, value: "$", pos: start, end: i})
+				break
+			}
+
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated dollar-quoted string at offset %d", start)
+			}
+
+			i += len(tag) + end + len(tag)
+			tokens = append(tokens, token{kind: tokenString, value: query[start:i], pos: start, end: i})
+		case isIdentStart(c):
+			for i < len(query) && isIdentChar(query[i]) {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenIdent, value: strings.ToLower(query[start:i]), pos: start, end: i})
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			i = skipNumber(query, i)
+			tokens = append(tokens, token{kind: tokenNumber, value: query[start:i], pos: start, end: i})
+		case c == ':' && i+1 < len(query) && query[i+1] == ':':
+			i += 2
+			tokens = append(tokens, token{kind: tokenPunct, value: "::", pos: start, end: i})
+		case strings.IndexByte("()[],;.:", c) >= 0:
+			i++
+			tokens = append(tokens, token{kind: tokenPunct, value: query[start:i], pos: start, end: i})
+		case strings.IndexByte(operatorChars, c) >= 0:
+			// an operator ends where a comment starts
+			for i < len(query) && strings.IndexByte(operatorChars, query[i]) >= 0 &&
+				!strings.HasPrefix(query[i:], "--") && !strings.HasPrefix(query[i:], "/*") {
+				i++
+			}
+
+			tokens = append(tokens, token{kind: tokenOperator, value: query[start:i], pos: start, end: i})
+		default:
+			i++
+			tokens = append(tokens, token{kind: tokenOperator, value: query[start:i], pos: start, end: i})
+		}
+	}
+
+	return tokens, nil
+}
+
+// skipBlockComment returns the offset past the comment starting at
+// query[start]. Block comments nest.
+func skipBlockComment(query string, start int) (int, error) {
+	depth := 0
+
+	for i := start; i < len(query)-1; i++ {
+		switch query[i : i+2] {
+		case "/*":
+			depth++
+			i++
+		case "*/":
+			depth--
+			i++
+
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("unterminated comment at offset %d", start)
+}
+
+// skipString returns the offset past the string constant whose opening quote
+// is query[start]. Backslashes only escape in E'...' strings.
+func skipString(query string, start int, escapes bool) (int, error) {
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case escapes && query[i] == '\\':
+			i++
+		case query[i] == '\'':
+			if i+1 < len(query) && query[i+1] == '\'' {
+				i++
+				continue
+			}
+
+			return i + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unterminated quoted string at offset %d", start)
+}
+
+// quotedIdent returns the identifier whose opening quote is query[start]
+// and the offset past it
+func quotedIdent(query string, start int) (string, int, error) {
+	var value strings.Builder
+
+	for i := start + 1; i < len(query); i++ {
+		if query[i] != '"' {
+			value.WriteByte(query[i])
+			continue
+		}
+
+		if i+1 < len(query) && query[i+1] == '"' {
+			value.WriteByte('"')
+			i++
+			continue
+		}
+
+		return value.String(), i + 1, nil
+	}
+
+	return "", 0, fmt.Errorf("unterminated quoted identifier at offset %d", start)
+}
+
+// dollarTag returns the $tag$ opening a dollar-quoted string at query[start]
+func dollarTag(query string, start int) (string, bool) {
+	i := start + 1
+	if i < len(query) && query[i] != '$' && !isIdentStart(query[i]) {
+		return "", false
+	}
+
+	for i < len(query) && query[i] != '$' {
+		if !isIdentChar(query[i]) {
+			return "", false
+		}
+
+		i++
+	}
+
+	if i >= len(query) {
+		return "", false
+	}
+
+	return query[start : i+1], true
+}
+
+func skipNumber(query string, i int) int {
+	for i < len(query) && (isDigit(query[i]) || query[i] == '_' || query[i] == '.') {
+		// 1..10 is two numbers around an operator, as in array slices
+		if query[i] == '.' && i+1 < len(query) && query[i+1] == '.' {
+			return i
+		}
+
+		i++
+	}
+
+	if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		j := i + 1
+		if j < len(query) && (query[j] == '+' || query[j] == '-') {
+			j++
+		}
+
+		if j < len(query) && isDigit(query[j]) {
+			i = j
+			for i < len(query) && isDigit(query[i]) {
+				i++
+			}
+		}
+	}
+
+	return i
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c) || c == '$'
+}
@@ -0,0 +1,143 @@
+// Package sqlparser reads PostgreSQL statements as far as the proxy needs to
+// route, authorize and audit them. It splits a query string into statements
+// and tells for each what kind of statement it is, whether a replica can run
+// it, which tables and schemas it touches, whether it begins or ends a
+// transaction block and whether it does something dangerous enough for the
+// firewall to look at. It does not check that a statement is valid; the
+// backend does that.
+package sqlparser
+
+// Class tells where a statement can run
+type Class int
+
+const (
+	Write Class = iota // needs the primary; so does any statement the parser does not recognize
+	Read               // a replica can run it
+)
+
+func (c Class) String() string {
+	if c == Read {
+		return "read"
+	}
+
+	return "write"
+}
+
+// Table is a relation a statement names, with the schema it was qualified
+// with, if any
+type Table struct {
+	Schema string
+	Name   string
+}
+
+func (t Table) String() string {
+	if t.Schema == "" {
+		return t.Name
+	}
+
+	return t.Schema + "." + t.Name
+}
+
+// Statement is one statement of a query string
+type Statement struct {
+	Text        string   // the statement as written, without leading comments or the closing semicolon
+	Normalized  string   // the statement with its constants and parameters replaced by $1, $2, ...
+	Fingerprint string   // a hash of Normalized, the same for statements that differ only in their values
+	Type        string   // the command, as in SELECT, INSERT or CREATE TABLE; empty when not recognized
+	Class       Class    // whether a replica can run it
+	Modifies    bool     // it changes data, the schema or the server, rather than reading or controlling the session and its transactions
+	Tables      []Table  // relations it names, each once
+	Schemas     []string // schemas it names, directly or by qualifying a relation
+
+	BeginsTransaction bool // BEGIN, START TRANSACTION, or a COMMIT or ROLLBACK AND CHAIN
+	EndsTransaction   bool // COMMIT, ROLLBACK, END, ABORT or PREPARE TRANSACTION
+
+	Unfiltered  bool // an UPDATE or DELETE in it, WITH queries included, has no WHERE clause
+	CopyProgram bool // COPY ... TO PROGRAM or FROM PROGRAM, which runs a shell command on the server
+
+	// SessionState is set for statements that leave state behind in the
+	// backend session once their transaction ends: SET and RESET, LISTEN,
+	// LOAD, PREPARE, DECLARE ... WITH HOLD, temporary tables, advisory locks
+	// and set_config
+	SessionState bool
+}
+
+// Parse splits query into its statements and analyses each of them. Empty
+// statements are left out. It fails only when a quoted string, quoted
+// identifier or comment is never closed.
+func Parse(query string) ([]Statement, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []Statement
+
+	for _, group := range split(tokens) {
+		statement := analyze(group)
+		statement.Text = query[group[0].pos:group[len(group)-1].end]
+		statement.Normalized = normalize(group)
+		statement.Fingerprint = fingerprint(statement.Normalized)
+
+		statements = append(statements, statement)
+	}
+
+	return statements, nil
+}
+
+// Classify returns the class of a query string: Read when a replica can run
+// every statement in it, Write otherwise, and for a query that does not parse
+// or holds no statement at all
+func Classify(query string) Class {
+	statements, err := Parse(query)
+	if err != nil || len(statements) == 0 {
+		return Write
+	}
+
+	for _, statement := range statements {
+		if statement.Class == Write {
+			return Write
+		}
+	}
+
+	return Read
+}
+
+// split cuts tokens into statements at the semicolons outside parentheses.
+// The body of a CREATE FUNCTION ... BEGIN ATOMIC ... END is one statement
+// even though it holds semicolons, as psql also sees it.
+func split(tokens []token) [][]token {
+	var (
+		statements [][]token
+		start      int
+		depth      int
+		atomic     int // open BEGIN ATOMIC and CASE blocks of a function body
+	)
+
+	for i, t := range tokens {
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			depth = max(depth-1, 0)
+		case t.is("ATOMIC") && i > start && tokens[i-1].is("BEGIN") && tokens[start].is("CREATE"):
+			atomic++
+		case atomic > 0 && t.is("CASE"):
+			atomic++
+		case atomic > 0 && t.is("END"):
+			atomic--
+		case t.isPunct(";") && depth == 0 && atomic == 0:
+			if i > start {
+				statements = append(statements, tokens[start:i])
+			}
+
+			start = i + 1
+		}
+	}
+
+	if start < len(tokens) {
+		statements = append(statements, tokens[start:])
+	}
+
+	return statements
+}
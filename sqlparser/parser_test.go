@@ -0,0 +1,258 @@
+package sqlparser
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Class
+	}{
+		{"SELECT 1", Read},
+		{"  -- comment\n/* a /* nested */ */ select * from t", Read},
+		{"(SELECT a FROM t1) UNION (SELECT b FROM t2)", Read},
+		{"WITH x AS (SELECT * FROM a) SELECT * FROM x", Read},
+		{"VALUES (1), (2)", Read},
+		{"TABLE t", Read},
+		{"SHOW search_path", Read},
+		{"EXPLAIN DELETE FROM t", Read},
+		{"COPY t TO STDOUT", Read},
+		{"SET session_replication_role = replica", Read},
+		{"SELECT 1; SELECT 2", Read},
+
+		{"INSERT INTO t VALUES (1)", Write},
+		{"UPDATE t SET a = 1 WHERE id = 2", Write},
+		{"DELETE FROM t WHERE id = 1", Write},
+		{"CREATE TABLE t (id int)", Write},
+		{"WITH x AS (DELETE FROM a RETURNING *) SELECT * FROM x", Write},
+		{"SELECT * FROM t FOR UPDATE", Write},
+		{"SELECT * FROM t FOR NO KEY UPDATE OF t", Write},
+		{"SELECT a INTO newt FROM old", Write},
+		{"SELECT nextval('s')", Write},
+		{"SELECT pg_advisory_lock(1)", Write},
+		{"SELECT pg_catalog.pg_try_advisory_xact_lock(1, 2)", Write},
+		{"SELECT pg_notify('channel', 'payload')", Write},
+		{"SELECT pg_terminate_backend(42)", Write},
+		{"EXPLAIN ANALYZE DELETE FROM t", Write},
+		{"COPY t FROM STDIN", Write},
+		{"COPY t TO PROGRAM 'gzip > /tmp/t.gz'", Write},
+		{"COPY (SELECT 1) TO PROGRAM 'cat'", Write},
+		{"SET search_path TO app", Write},
+		{"DESCRIBE t", Write},
+		{"BEGIN", Write},
+		{"SELECT 1; DELETE FROM t", Write},
+		{"SELECT 1 -- comment\r; DROP TABLE t", Write},
+		{"", Write},
+		{"SELECT 'unterminated", Write},
+	}
+
+	for _, test := range tests {
+		if got := Classify(test.query); got != test.want {
+			t.Errorf("Classify(%q) = %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseSplits(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{";; SELECT 1 ;;", []string{"SELECT 1"}},
+		{"-- leading\nSELECT 1; /* next */ SELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT 1 -- x\r; DROP TABLE t", []string{"SELECT 1", "DROP TABLE t"}},
+		{"INSERT INTO t VALUES ('a;b'); SELECT \"x;y\" FROM t", []string{"INSERT INTO t VALUES ('a;b')", `SELECT "x;y" FROM t`}},
+		{"SELECT $$a;b$$; SELECT $tag$;$tag$", []string{"SELECT $$a;b$$", "SELECT $tag$;$tag$"}},
+		{
+			"CREATE FUNCTION f() RETURNS int LANGUAGE sql BEGIN ATOMIC SELECT 1; SELECT 2; END; SELECT f()",
+			[]string{"CREATE FUNCTION f() RETURNS int LANGUAGE sql BEGIN ATOMIC SELECT 1; SELECT 2; END", "SELECT f()"},
+		},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		statements, err := Parse(test.query)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.query, err)
+			continue
+		}
+
+		var got []string
+		for _, statement := range statements {
+			got = append(got, statement.Text)
+		}
+
+		if !slices.Equal(got, test.want) {
+			t.Errorf("Parse(%q) split into %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseFailsUnterminated(t *testing.T) {
+	for _, query := range []string{"SELECT 'a", `SELECT "a`, "SELECT 1 /* a", "SELECT $$a"} {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", query)
+		}
+	}
+}
+
+func TestParseTables(t *testing.T) {
+	tests := []struct {
+		query   string
+		tables  []string
+		schemas []string
+	}{
+		{"SELECT * FROM public.users u JOIN orders o ON o.uid = u.id WHERE x IN (SELECT y FROM s.t)",
+			[]string{"public.users", "orders", "s.t"}, []string{"public", "s"}},
+		{"WITH x AS (SELECT * FROM a) SELECT * FROM x, b", []string{"a", "b"}, nil},
+		{"SELECT extract(year from d), a IS DISTINCT FROM b FROM t", []string{"t"}, nil},
+		{"SELECT * FROM generate_series(1, 3) g, LATERAL (SELECT * FROM u) z", []string{"u"}, nil},
+		{`INSERT INTO "My Table" (a) VALUES (1)`, []string{"My Table"}, nil},
+		{"UPDATE ONLY t SET a = 1 FROM u WHERE t.id = u.id", []string{"t", "u"}, nil},
+		{"DELETE FROM t USING u, v WHERE t.id = u.id", []string{"t", "u", "v"}, nil},
+		{"MERGE INTO t USING s ON t.id = s.id WHEN MATCHED THEN DELETE", []string{"t", "s"}, nil},
+		{"CREATE TABLE IF NOT EXISTS app.t (id int REFERENCES app.u (id))", []string{"app.t", "app.u"}, []string{"app"}},
+		{"CREATE INDEX i ON t (a)", []string{"t"}, nil},
+		{"DROP TABLE IF EXISTS a, b.c CASCADE", []string{"a", "b.c"}, []string{"b"}},
+		{"TRUNCATE a, b", []string{"a", "b"}, nil},
+		{"COPY t (a, b) FROM STDIN", []string{"t"}, nil},
+		{"CREATE SCHEMA IF NOT EXISTS reporting", nil, []string{"reporting"}},
+		{"GRANT SELECT ON TABLE t TO r", []string{"t"}, nil},
+	}
+
+	for _, test := range tests {
+		statements, err := Parse(test.query)
+		if err != nil || len(statements) != 1 {
+			t.Errorf("Parse(%q) = %d statements, %v", test.query, len(statements), err)
+			continue
+		}
+
+		var tables []string
+		for _, table := range statements[0].Tables {
+			tables = append(tables, table.String())
+		}
+
+		if !slices.Equal(tables, test.tables) {
+			t.Errorf("tables of %q = %q, want %q", test.query, tables, test.tables)
+		}
+
+		if !slices.Equal(statements[0].Schemas, test.schemas) {
+			t.Errorf("schemas of %q = %q, want %q", test.query, statements[0].Schemas, test.schemas)
+		}
+	}
+}
+
+func TestParseStatement(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Statement
+	}{
+		{"SELECT 1", Statement{Type: "SELECT"}},
+		{"CREATE OR REPLACE VIEW v AS SELECT 1", Statement{Type: "CREATE VIEW"}},
+		{"CREATE MATERIALIZED VIEW mv AS SELECT 1", Statement{Type: "CREATE MATERIALIZED VIEW"}},
+		{"DROP TABLE t", Statement{Type: "DROP TABLE"}},
+		{"BEGIN", Statement{Type: "BEGIN", BeginsTransaction: true}},
+		{"START TRANSACTION READ ONLY", Statement{Type: "START TRANSACTION", BeginsTransaction: true}},
+		{"COMMIT", Statement{Type: "COMMIT", EndsTransaction: true}},
+		{"COMMIT AND CHAIN", Statement{Type: "COMMIT", BeginsTransaction: true, EndsTransaction: true}},
+		{"ROLLBACK TO SAVEPOINT s", Statement{Type: "ROLLBACK"}},
+		{"COMMIT PREPARED 'x'", Statement{Type: "COMMIT"}},
+		{"PREPARE TRANSACTION 'x'", Statement{Type: "PREPARE", EndsTransaction: true}},
+		{"DELETE FROM t", Statement{Type: "DELETE", Unfiltered: true}},
+		{"DELETE FROM t WHERE id = 1", Statement{Type: "DELETE"}},
+		{"UPDATE t SET a = (SELECT b FROM u WHERE c)", Statement{Type: "UPDATE", Unfiltered: true}},
+		{"WITH d AS (DELETE FROM t) SELECT 1", Statement{Type: "SELECT", Unfiltered: true}},
+		{"EXPLAIN DELETE FROM t", Statement{Type: "EXPLAIN"}},
+		{"EXPLAIN ANALYZE DELETE FROM t", Statement{Type: "EXPLAIN", Unfiltered: true}},
+		{"COPY t TO PROGRAM 'cat'", Statement{Type: "COPY", CopyProgram: true}},
+		{"COPY t (a, b) FROM PROGRAM 'cat'", Statement{Type: "COPY", CopyProgram: true}},
+		{"COPY t TO STDOUT", Statement{Type: "COPY"}},
+		{"SET search_path TO app", Statement{Type: "SET", SessionState: true}},
+		{"SET LOCAL work_mem = '1MB'", Statement{Type: "SET"}},
+		{"SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", Statement{Type: "SET"}},
+		{"RESET ALL", Statement{Type: "RESET", SessionState: true}},
+		{"LISTEN channel", Statement{Type: "LISTEN", SessionState: true}},
+		{"PREPARE s AS SELECT 1", Statement{Type: "PREPARE", SessionState: true}},
+		{"DECLARE c CURSOR WITH HOLD FOR SELECT 1", Statement{Type: "DECLARE", SessionState: true}},
+		{"DECLARE c CURSOR FOR SELECT 1", Statement{Type: "DECLARE"}},
+		{"CREATE TEMP TABLE t (a int)", Statement{Type: "CREATE TABLE", SessionState: true}},
+		{"SELECT a INTO TEMPORARY t FROM u", Statement{Type: "SELECT", SessionState: true}},
+		{"SELECT pg_advisory_lock(1)", Statement{Type: "SELECT", SessionState: true}},
+		{"SELECT set_config('a.b', 'c', false)", Statement{Type: "SELECT", SessionState: true}},
+		{"SELECT 'pg_advisory_lock(1)'", Statement{Type: "SELECT"}},
+	}
+
+	for _, test := range tests {
+		statements, err := Parse(test.query)
+		if err != nil || len(statements) != 1 {
+			t.Errorf("Parse(%q) = %d statements, %v", test.query, len(statements), err)
+			continue
+		}
+
+		got := statements[0]
+		if got.Type != test.want.Type ||
+			got.BeginsTransaction != test.want.BeginsTransaction ||
+			got.EndsTransaction != test.want.EndsTransaction ||
+			got.Unfiltered != test.want.Unfiltered ||
+			got.CopyProgram != test.want.CopyProgram ||
+			got.SessionState != test.want.SessionState {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseModifies(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT 1", false},
+		{"BEGIN READ ONLY", false},
+		{"START TRANSACTION", false},
+		{"COMMIT", false},
+		{"ROLLBACK TO SAVEPOINT s", false},
+		{"SAVEPOINT s", false},
+		{"RELEASE SAVEPOINT s", false},
+		{"SET search_path TO app", false},
+		{"RESET ALL", false},
+		{"SHOW work_mem", false},
+		{"DECLARE c CURSOR FOR SELECT * FROM t", false},
+		{"FETCH 10 FROM c", false},
+		{"CLOSE c", false},
+		{"DISCARD ALL", false},
+		{"DEALLOCATE ALL", false},
+		{"PREPARE s AS SELECT * FROM t", false},
+		{"EXPLAIN DELETE FROM t", false},
+
+		{"INSERT INTO t VALUES (1)", true},
+		{"DELETE FROM t", true},
+		{"CREATE TABLE t (a int)", true},
+		{"SELECT * FROM t FOR UPDATE", true},
+		{"SELECT nextval('s')", true},
+		{"DECLARE c CURSOR FOR SELECT * FROM t FOR UPDATE", true},
+		{"PREPARE s AS DELETE FROM t", true},
+		{"PREPARE TRANSACTION 'x'", true},
+		{"COMMIT PREPARED 'x'", true},
+		{"EXPLAIN ANALYZE DELETE FROM t", true},
+		{"EXECUTE s", true},
+		{"VACUUM t", true},
+		{"CALL p()", true},
+		{"NOTIFY c", true},
+	}
+
+	for _, test := range tests {
+		statements, err := Parse(test.query)
+		if err != nil || len(statements) != 1 {
+			t.Errorf("Parse(%q) = %d statements, %v", test.query, len(statements), err)
+			continue
+		}
+
+		if got := statements[0].Modifies; got != test.want {
+			t.Errorf("Modifies of %q = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"regexp"
+)
+
+// serverStatementPrefix marks the statements the proxy prepares on backends
+const serverStatementPrefix = "proxy_"
+
+var (
+	parseComplete = []byte{'1', 0, 0, 0, 4}
+	closeComplete = []byte{'3', 0, 0, 0, 4}
+
+	// statements that deallocate every prepared statement of the session
+	deallocateAllPattern = regexp.MustCompile(`(?i)^\s*(DEALLOCATE\s+(PREPARE\s+)?ALL|DISCARD\s+ALL)\s*;?\s*$`)
+)
+
+// preparedStatement is a statement a client prepared under its own name. The
+// backends know it under serverName, derived from its text and parameter
+// types, so that clients sharing a backend never collide and each backend
+// prepares a statement once.
+type preparedStatement struct {
+	query      string
+	paramTypes []uint32
+	serverName string
+}
+
+func newPreparedStatement(query string, paramTypes []uint32) *preparedStatement {
+	hash := sha256.New()
+	hash.Write([]byte(query))
+
+	for _, oid := range paramTypes {
+		_ = binary.Write(hash, binary.BigEndian, oid)
+	}
+
+	return &preparedStatement{
+		query:      query,
+		paramTypes: paramTypes,
+		serverName: serverStatementPrefix + hex.EncodeToString(hash.Sum(nil)[:16]),
+	}
+}
+
+// expectsReply reports whether the backend answers a frontend message of type
+// msgType, so that it has a pendingReply of its own
+func expectsReply(msgType byte) bool {
+	switch msgType {
+	case 'P', 'B', 'D', 'E', 'C', 'S', 'Q', 'F':
+		return true
+	}
+
+	return false
+}
+
+// prepareStatements rewrites the client messages in data for backend. Named
+// statements are renamed to their server names, a statement the backend does
+// not have yet is prepared ahead of the Bind or Describe that uses it, and
+// Parse and Close messages the backend does not need are answered by the
+// proxy. replies holds the reply to each answered message in data, in order.
+// The caller must hold s.lock.
+func (s *Session) prepareStatements(backend *backendConn, data []byte, replies []*pendingReply) ([]byte, []*pendingReply) {
+	var (
+		out        = make([]byte, 0, len(data))
+		outReplies = make([]*pendingReply, 0, len(replies))
+		prepared   = backend.server.prepared
+	)
+
+	// ensure prepares a statement on the backend unless it already has it
+	ensure := func(name string) string {
+		statement, ok := s.statements[name]
+		if !ok {
+			// unknown names reach the backend as they are, which reports them
+			return name
+		}
+
+		if !prepared[statement.serverName] {
+			prepared[statement.serverName] = true
+
+			out = append(out, encodeParse(statement.serverName, statement.query, statement.paramTypes)...)
+			outReplies = append(outReplies, &pendingReply{msgType: 'P', internal: true, statement: statement.serverName})
+		}
+
+		return statement.serverName
+	}
+
+	for len(data) >= 5 {
+		length := 1 + int(binary.BigEndian.Uint32(data[1:5]))
+		if length > len(data) {
+			length = len(data)
+		}
+
+		msg := data[:length]
+		data = data[length:]
+
+		var reply *pendingReply
+		if expectsReply(msg[0]) && len(replies) > 0 {
+			reply, replies = replies[0], replies[1:]
+		}
+
+		switch msg[0] {
+		case 'P':
+			name, query, paramTypes, err := parseParseMessage(msg)
+			if err != nil || name == "" || reply == nil {
+				break
+			}
+
+			statement := newPreparedStatement(query, paramTypes)
+			if prepared[statement.serverName] {
+				msg, reply.fake = nil, parseComplete
+				break
+			}
+
+			prepared[statement.serverName] = true
+			reply.statement = statement.serverName
+			msg = encodeParse(statement.serverName, query, paramTypes)
+		case 'B':
+			portalEnd := bytes.IndexByte(msg[5:], 0)
+			if portalEnd < 0 {
+				break
+			}
+
+			start := 5 + portalEnd + 1
+			if name, ok := cString(msg, start); ok {
+				msg = replaceCString(msg, start, ensure(name))
+			}
+		case 'D':
+			if len(msg) > 6 && msg[5] == 'S' {
+				if name, ok := cString(msg, 6); ok {
+					msg = replaceCString(msg, 6, ensure(name))
+				}
+			}
+		case 'C':
+			// the statement stays on the backend for other clients
+			if len(msg) > 6 && msg[5] == 'S' && reply != nil {
+				if name, ok := cString(msg, 6); ok && name != "" {
+					msg, reply.fake = nil, closeComplete
+				}
+			}
+		case 'Q':
+			if deallocateAllPattern.Match(bytes.TrimRight(msg[5:], "\x00")) {
+				clear(prepared)
+			}
+		}
+
+		out = append(out, msg...)
+
+		if reply != nil {
+			outReplies = append(outReplies, reply)
+		}
+	}
+
+	return append(out, data...), append(outReplies, replies...)
+}
+
+// cString returns the null-terminated string starting at msg[start]
+func cString(msg []byte, start int) (string, bool) {
+	if start > len(msg) {
+		return "", false
+	}
+
+	end := bytes.IndexByte(msg[start:], 0)
+	if end < 0 {
+		return "", false
+	}
+
+	return string(msg[start : start+end]), true
+}
+
+// replaceCString replaces the null-terminated string starting at msg[start]
+// with value and fixes the message length
+func replaceCString(msg []byte, start int, value string) []byte {
+	end := start + bytes.IndexByte(msg[start:], 0)
+
+	out := make([]byte, 0, len(msg)+len(value))
+	out = append(out, msg[:start]...)
+	out = append(out, value...)
+	out = append(out, msg[end:]...)
+
+	binary.BigEndian.PutUint32(out[1:5], uint32(len(out)-1))
+
+	return out
+}
+
+// encodeParse builds a Parse message
+func encodeParse(name, query string, paramTypes []uint32) []byte {
+	msg := []byte{'P', 0, 0, 0, 0}
+	msg = append(msg, name...)
+	msg = append(msg, 0)
+	msg = append(msg, query...)
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(paramTypes)))
+
+	for _, oid := range paramTypes {
+		msg = binary.BigEndian.AppendUint32(msg, oid)
+	}
+
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+
+	return msg
+}
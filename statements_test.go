@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func encodeBind(statement string) []byte {
+	return frame('B', []byte("\x00"+statement+"\x00\x00\x00\x00\x00\x00\x00"))
+}
+
+func encodeDescribeStatement(statement string) []byte {
+	return frame('D', []byte("S"+statement+"\x00"))
+}
+
+func encodeCloseStatement(statement string) []byte {
+	return frame('C', []byte("S"+statement+"\x00"))
+}
+
+// frame prefixes a message body with its type and length
+func frame(msgType byte, body []byte) []byte {
+	length := len(body) + 4
+
+	return append([]byte{msgType, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}, body...)
+}
+
+func concat(messages ...[]byte) []byte {
+	return bytes.Join(messages, nil)
+}
+
+func repliesFor(msgTypes ...byte) []*pendingReply {
+	replies := make([]*pendingReply, len(msgTypes))
+	for i, msgType := range msgTypes {
+		replies[i] = &pendingReply{msgType: msgType}
+	}
+
+	return replies
+}
+
+func testSession(statements ...string) (*Session, *backendConn) {
+	session := &Session{statements: make(map[string]*preparedStatement)}
+	for _, name := range statements {
+		session.statements[name] = newPreparedStatement("SELECT $1", []uint32{23})
+	}
+
+	return session, &backendConn{server: &ServerConn{prepared: make(map[string]bool)}}
+}
+
+func TestPrepareStatementsParse(t *testing.T) {
+	session, backend := testSession()
+	serverName := newPreparedStatement("SELECT $1", []uint32{23}).serverName
+
+	data, replies := session.prepareStatements(backend, encodeParse("s1", "SELECT $1", []uint32{23}), repliesFor('P'))
+
+	if want := encodeParse(serverName, "SELECT $1", []uint32{23}); !bytes.Equal(data, want) {
+		t.Errorf("first Parse = %q, want %q", data, want)
+	}
+
+	if len(replies) != 1 || replies[0].statement != serverName || replies[0].fake != nil {
+		t.Errorf("first Parse reply = %+v", replies[0])
+	}
+
+	// another client's Parse of the same statement is answered by the proxy
+	data, replies = session.prepareStatements(backend, encodeParse("s2", "SELECT $1", []uint32{23}), repliesFor('P'))
+
+	if len(data) != 0 {
+		t.Errorf("second Parse reached the backend: %q", data)
+	}
+
+	if len(replies) != 1 || !bytes.Equal(replies[0].fake, parseComplete) {
+		t.Errorf("second Parse reply = %+v, want ParseComplete", replies[0])
+	}
+
+	// the same text with other parameter types is another statement
+	data, _ = session.prepareStatements(backend, encodeParse("s3", "SELECT $1", []uint32{25}), repliesFor('P'))
+
+	if len(data) == 0 {
+		t.Error("Parse with other parameter types was answered by the proxy")
+	}
+}
+
+func TestPrepareStatementsBind(t *testing.T) {
+	session, backend := testSession("s1")
+	statement := session.statements["s1"]
+
+	data, replies := session.prepareStatements(backend, concat(encodeBind("s1"), encodeDescribeStatement("s1")), repliesFor('B', 'D'))
+
+	want := concat(encodeParse(statement.serverName, statement.query, statement.paramTypes), encodeBind(statement.serverName), encodeDescribeStatement(statement.serverName))
+	if !bytes.Equal(data, want) {
+		t.Errorf("Bind on a new backend = %q, want %q", data, want)
+	}
+
+	if len(replies) != 3 || !replies[0].internal || replies[0].msgType != 'P' || replies[1].msgType != 'B' || replies[2].msgType != 'D' {
+		t.Errorf("replies = %+v, want the added Parse ahead of Bind and Describe", replies)
+	}
+
+	// once prepared, the statement is only renamed
+	data, replies = session.prepareStatements(backend, encodeBind("s1"), repliesFor('B'))
+
+	if !bytes.Equal(data, encodeBind(statement.serverName)) || len(replies) != 1 {
+		t.Errorf("Bind on a prepared backend = %q, %d replies", data, len(replies))
+	}
+
+	// unnamed and unknown statements reach the backend as they are
+	input := concat(encodeBind(""), encodeBind("missing"))
+
+	if data, _ = session.prepareStatements(backend, input, repliesFor('B', 'B')); !bytes.Equal(data, input) {
+		t.Errorf("unnamed and unknown statements = %q, want %q", data, input)
+	}
+}
+
+func TestPrepareStatementsClose(t *testing.T) {
+	session, backend := testSession("s1")
+	backend.server.prepared[session.statements["s1"].serverName] = true
+
+	data, replies := session.prepareStatements(backend, concat(encodeCloseStatement("s1"), frame('S', nil)), repliesFor('C', 'S'))
+
+	if !bytes.Equal(data, frame('S', nil)) {
+		t.Errorf("Close reached the backend: %q", data)
+	}
+
+	if len(replies) != 2 || !bytes.Equal(replies[0].fake, closeComplete) || replies[1].fake != nil {
+		t.Errorf("replies = %+v, want CloseComplete from the proxy", replies)
+	}
+
+	if !backend.server.prepared[session.statements["s1"].serverName] {
+		t.Error("Close dropped the statement from the backend")
+	}
+}
+
+func TestPrepareStatementsDeallocateAll(t *testing.T) {
+	for _, query := range []string{"DEALLOCATE ALL", "deallocate prepare all;", "DISCARD ALL"} {
+		session, backend := testSession("s1")
+		backend.server.prepared[session.statements["s1"].serverName] = true
+
+		session.prepareStatements(backend, encodeSimpleQuery(query), repliesFor('Q'))
+
+		if len(backend.server.prepared) != 0 {
+			t.Errorf("%q left prepared statements %v", query, backend.server.prepared)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import "sync/atomic"
+
+// proxyStats are the proxy's counters, updated atomically
+type proxyStats struct {
+	pinnedSessions      int64  // transaction-pooled sessions currently pinned to a backend
+	pinnedSessionsTotal uint64 // sessions pinned since the proxy started
+}
+
+// SessionStats is the session summary served on /stats/sessions
+type SessionStats struct {
+	Sessions            int    `json:"sessions"`
+	PinnedSessions      int64  `json:"pinned_sessions"`
+	PinnedSessionsTotal uint64 `json:"pinned_sessions_total"`
+}
+
+func (p *Proxy) sessionStats() SessionStats {
+	p.sessionsLock.Lock()
+	sessions := len(p.sessions)
+	p.sessionsLock.Unlock()
+
+	return SessionStats{
+		Sessions:            sessions,
+		PinnedSessions:      atomic.LoadInt64(&p.stats.pinnedSessions),
+		PinnedSessionsTotal: atomic.LoadUint64(&p.stats.pinnedSessionsTotal),
+	}
+}
+
+// UpstreamPoolStats is one upstream's connection pool as served on
+// /stats/pools. Pool is nil while the upstream is down.
+type UpstreamPoolStats struct {
+	Addr    string     `json:"addr"`
+	Name    string     `json:"name"`
+	Group   string     `json:"group,omitempty"`
+	Role    string     `json:"role"`
+	Healthy bool       `json:"healthy"`
+	Pool    *PoolStats `json:"pool"`
+}
+
+func (p *Proxy) poolStats() []UpstreamPoolStats {
+	p.lock.Lock()
+	upstreams := append([]*Upstream{p.primary}, p.servers...)
+	upstreams = append(upstreams, p.unhealthy...)
+
+	stats := make([]UpstreamPoolStats, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		entry := UpstreamPoolStats{Addr: upstream.Addr, Name: upstream.Name, Group: upstream.Group, Role: upstream.Role.String(), Healthy: upstream.Healthy}
+
+		if pool := upstream.pool.Load(); pool != nil {
+			stats := pool.Stats()
+			entry.Pool = &stats
+		}
+
+		stats = append(stats, entry)
+	}
+
+	p.lock.Unlock()
+
+	return stats
+}
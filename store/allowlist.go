@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type AllowlistInterface interface {
+	Record(ctx context.Context, requestID uuid.UUID, payload AllowlistEntry) (*AllowlistEntry, error)
+	Put(ctx context.Context, requestID uuid.UUID, payload AllowlistEntry) (*AllowlistEntry, error)
+	SetStatus(ctx context.Context, requestID uuid.UUID, entryID uuid.UUID, status string) (*AllowlistEntry, error)
+	GetAll(ctx context.Context, requestID uuid.UUID) ([]AllowlistEntry, error)
+	GetPaginatedEntries(ctx context.Context, requestID uuid.UUID, proxyUser, status string, page, pageSize int) (PaginatedResult[[]AllowlistEntry], error)
+}
+
+// Compile-time check
+var _ AllowlistInterface = (*AllowlistStore)(nil)
+
+type AllowlistStore struct {
+	db     *gorm.DB
+	logger *zerolog.Logger
+}
+
+func NewAllowlistStore(logger *zerolog.Logger, db *gorm.DB) AllowlistInterface {
+	return &AllowlistStore{
+		logger: logger,
+		db:     db,
+	}
+}
+
+// Record stores the entry unless its user already has one for the
+// fingerprint, and returns the stored entry either way
+func (a AllowlistStore) Record(ctx context.Context, requestID uuid.UUID, payload AllowlistEntry) (*AllowlistEntry, error) {
+	log := a.logger.With().
+		Str(MethodStrHelper, "allowlist.Record").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to record a query fingerprint")
+
+	return a.upsert(ctx, log, payload, clause.OnConflict{
+		Columns:   []clause.Column{{Name: "proxy_user"}, {Name: "fingerprint"}},
+		DoNothing: true,
+	})
+}
+
+// Put stores the entry, replacing the status of the one its user already has
+// for the fingerprint
+func (a AllowlistStore) Put(ctx context.Context, requestID uuid.UUID, payload AllowlistEntry) (*AllowlistEntry, error) {
+	log := a.logger.With().
+		Str(MethodStrHelper, "allowlist.Put").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to put a query fingerprint")
+
+	return a.upsert(ctx, log, payload, clause.OnConflict{
+		Columns:   []clause.Column{{Name: "proxy_user"}, {Name: "fingerprint"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "updated_at"}),
+	})
+}
+
+func (a AllowlistStore) upsert(ctx context.Context, log zerolog.Logger, payload AllowlistEntry, conflict clause.OnConflict) (*AllowlistEntry, error) {
+	if err := a.db.WithContext(ctx).Clauses(conflict).Create(&payload).Error; err != nil {
+		log.Err(err).Msg("Failed to store query fingerprint")
+		return nil, err
+	}
+
+	var entry AllowlistEntry
+
+	if err := a.db.WithContext(ctx).
+		Where("proxy_user = ? AND fingerprint = ?", payload.ProxyUser, payload.Fingerprint).
+		First(&entry).Error; err != nil {
+		log.Err(err).Msg("Failed to get stored query fingerprint")
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// SetStatus approves or revokes an entry. It returns gorm.ErrRecordNotFound
+// when there is no such entry.
+func (a AllowlistStore) SetStatus(ctx context.Context, requestID uuid.UUID, entryID uuid.UUID, status string) (*AllowlistEntry, error) {
+	log := a.logger.With().
+		Str(MethodStrHelper, "allowlist.SetStatus").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msgf("Got a request to set the status of query fingerprint %v to %s", entryID, status)
+
+	result := a.db.WithContext(ctx).
+		Model(&AllowlistEntry{}).
+		Where("id = ?", entryID).
+		Updates(map[string]any{"status": status, "updated_at": time.Now()})
+	if result.Error != nil {
+		log.Err(result.Error).Msg("Failed to set query fingerprint status")
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var entry AllowlistEntry
+
+	if err := a.db.WithContext(ctx).Where("id = ?", entryID).First(&entry).Error; err != nil {
+		log.Err(err).Msg("Failed to get query fingerprint")
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// GetAll returns every entry, for the proxy to enforce
+func (a AllowlistStore) GetAll(ctx context.Context, requestID uuid.UUID) ([]AllowlistEntry, error) {
+	log := a.logger.With().
+		Str(MethodStrHelper, "allowlist.GetAll").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to get all query fingerprints")
+
+	var entries []AllowlistEntry
+
+	if err := a.db.WithContext(ctx).Find(&entries).Error; err != nil {
+		log.Err(err).Msg("Failed to get query fingerprints")
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// GetPaginatedEntries lists the entries, newest first, of one proxy user or
+// with one status when those are given
+func (a AllowlistStore) GetPaginatedEntries(ctx context.Context, requestID uuid.UUID, proxyUser, status string, page, pageSize int) (PaginatedResult[[]AllowlistEntry], error) {
+	log := a.logger.With().
+		Str(MethodStrHelper, "allowlist.GetPaginatedEntries").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to get paginated query fingerprints")
+
+	offset := (page - 1) * pageSize
+	result := PaginatedResult[[]AllowlistEntry]{
+		Result:   []AllowlistEntry{},
+		Page:     page,
+		PageSize: pageSize,
+	}
+
+	query := a.db.WithContext(ctx).Model(&AllowlistEntry{})
+
+	if proxyUser != "" {
+		query = query.Where("proxy_user = ?", proxyUser)
+	}
+
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	if err := query.Count(&result.TotalCount).Error; err != nil {
+		log.Err(err).Msg("Failed to count query fingerprints")
+		return result, err
+	}
+
+	if err := query.
+		Order("created_at DESC").
+		Offset(offset).
+		Limit(pageSize).
+		Find(&result.Result).Error; err != nil {
+		log.Err(err).Msg("Failed to get paginated query fingerprints")
+		return result, err
+	}
+
+	return result, nil
+}
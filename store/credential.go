@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+type UpstreamCredentialInterface interface {
+	Create(ctx context.Context, requestID uuid.UUID, payload UpstreamCredential) (*UpstreamCredential, error)
+	GetFor(ctx context.Context, requestID uuid.UUID, username, role string) (*UpstreamCredential, error)
+	GetPaginatedCredentials(ctx context.Context, requestID uuid.UUID, page, pageSize int) (PaginatedResult[[]UpstreamCredential], error)
+	Delete(ctx context.Context, requestID uuid.UUID, credentialID uuid.UUID) error
+}
+
+// Compile-time check
+var _ UpstreamCredentialInterface = (*UpstreamCredentialStore)(nil)
+
+type UpstreamCredentialStore struct {
+	db     *gorm.DB
+	logger *zerolog.Logger
+}
+
+func NewUpstreamCredentialStore(logger *zerolog.Logger, db *gorm.DB) UpstreamCredentialInterface {
+	return &UpstreamCredentialStore{
+		logger: logger,
+		db:     db,
+	}
+}
+
+func (u UpstreamCredentialStore) Create(ctx context.Context, requestID uuid.UUID, payload UpstreamCredential) (*UpstreamCredential, error) {
+	log := u.logger.With().
+		Str(MethodStrHelper, "credential.Create").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to create upstream credential")
+
+	if err := u.db.WithContext(ctx).Create(&payload).Error; err != nil {
+		log.Err(err).Msg("Failed to create upstream credential")
+		return nil, err
+	}
+
+	return &payload, nil
+}
+
+// GetFor returns the credential configured for a proxy user, falling back to
+// the one configured for its role. It returns nil when neither exists.
+func (u UpstreamCredentialStore) GetFor(ctx context.Context, requestID uuid.UUID, username, role string) (*UpstreamCredential, error) {
+	log := u.logger.With().
+		Str(MethodStrHelper, "credential.GetFor").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to get the upstream credential of a user")
+
+	var credential UpstreamCredential
+
+	err := u.db.WithContext(ctx).Where("proxy_user = ?", username).First(&credential).Error
+	if err == nil {
+		return &credential, nil
+	}
+
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Err(err).Msg("Failed to get upstream credential by user")
+		return nil, err
+	}
+
+	err = u.db.WithContext(ctx).Where("proxy_user = '' AND proxy_role = ?", role).First(&credential).Error
+	if err == nil {
+		return &credential, nil
+	}
+
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Err(err).Msg("Failed to get upstream credential by role")
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (u UpstreamCredentialStore) GetPaginatedCredentials(ctx context.Context, requestID uuid.UUID, page, pageSize int) (PaginatedResult[[]UpstreamCredential], error) {
+	log := u.logger.With().
+		Str(MethodStrHelper, "credential.GetPaginatedCredentials").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to get paginated upstream credentials")
+
+	offset := (page - 1) * pageSize
+	result := PaginatedResult[[]UpstreamCredential]{
+		Result:   []UpstreamCredential{},
+		Page:     page,
+		PageSize: pageSize,
+	}
+
+	query := u.db.WithContext(ctx).Model(&UpstreamCredential{})
+
+	if err := query.Count(&result.TotalCount).Error; err != nil {
+		log.Err(err).Msg("Failed to count upstream credentials")
+		return result, err
+	}
+
+	if err := query.
+		Offset(offset).
+		Limit(pageSize).
+		Find(&result.Result).Error; err != nil {
+		log.Err(err).Msg("Failed to get paginated upstream credentials")
+		return result, err
+	}
+
+	return result, nil
+}
+
+func (u UpstreamCredentialStore) Delete(ctx context.Context, requestID uuid.UUID, credentialID uuid.UUID) error {
+	log := u.logger.With().
+		Str(MethodStrHelper, "credential.Delete").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msgf("Got request to delete upstream credential with ID %v", credentialID)
+
+	result := u.db.WithContext(ctx).Where("id = ?", credentialID).Delete(&UpstreamCredential{})
+	if result.Error != nil {
+		log.Err(result.Error).Msg("Failed to delete upstream credential")
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
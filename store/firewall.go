@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+type FirewallRuleInterface interface {
+	Create(ctx context.Context, requestID uuid.UUID, payload FirewallRule) (*FirewallRule, error)
+	GetAll(ctx context.Context, requestID uuid.UUID) ([]FirewallRule, error)
+	GetPaginatedRules(ctx context.Context, requestID uuid.UUID, page, pageSize int) (PaginatedResult[[]FirewallRule], error)
+	Delete(ctx context.Context, requestID uuid.UUID, ruleID uuid.UUID) error
+}
+
+// Compile-time check
+var _ FirewallRuleInterface = (*FirewallRuleStore)(nil)
+
+type FirewallRuleStore struct {
+	db     *gorm.DB
+	logger *zerolog.Logger
+}
+
+func NewFirewallRuleStore(logger *zerolog.Logger, db *gorm.DB) FirewallRuleInterface {
+	return &FirewallRuleStore{
+		logger: logger,
+		db:     db,
+	}
+}
+
+func (f FirewallRuleStore) Create(ctx context.Context, requestID uuid.UUID, payload FirewallRule) (*FirewallRule, error) {
+	log := f.logger.With().
+		Str(MethodStrHelper, "firewall.Create").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to create firewall rule")
+
+	if err := f.db.WithContext(ctx).Create(&payload).Error; err != nil {
+		log.Err(err).Msg("Failed to create firewall rule")
+		return nil, err
+	}
+
+	return &payload, nil
+}
+
+// GetAll returns every rule, oldest first, for the proxy to enforce
+func (f FirewallRuleStore) GetAll(ctx context.Context, requestID uuid.UUID) ([]FirewallRule, error) {
+	log := f.logger.With().
+		Str(MethodStrHelper, "firewall.GetAll").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to get all firewall rules")
+
+	var rules []FirewallRule
+
+	if err := f.db.WithContext(ctx).Order("created_at").Find(&rules).Error; err != nil {
+		log.Err(err).Msg("Failed to get firewall rules")
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (f FirewallRuleStore) GetPaginatedRules(ctx context.Context, requestID uuid.UUID, page, pageSize int) (PaginatedResult[[]FirewallRule], error) {
+	log := f.logger.With().
+		Str(MethodStrHelper, "firewall.GetPaginatedRules").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msg("Got a request to get paginated firewall rules")
+
+	offset := (page - 1) * pageSize
+	result := PaginatedResult[[]FirewallRule]{
+		Result:   []FirewallRule{},
+		Page:     page,
+		PageSize: pageSize,
+	}
+
+	query := f.db.WithContext(ctx).Model(&FirewallRule{})
+
+	if err := query.Count(&result.TotalCount).Error; err != nil {
+		log.Err(err).Msg("Failed to count firewall rules")
+		return result, err
+	}
+
+	if err := query.
+		Order("created_at").
+		Offset(offset).
+		Limit(pageSize).
+		Find(&result.Result).Error; err != nil {
+		log.Err(err).Msg("Failed to get paginated firewall rules")
+		return result, err
+	}
+
+	return result, nil
+}
+
+func (f FirewallRuleStore) Delete(ctx context.Context, requestID uuid.UUID, ruleID uuid.UUID) error {
+	log := f.logger.With().
+		Str(MethodStrHelper, "firewall.Delete").
+		Str(RequestID, requestID.String()).
+		Logger()
+
+	log.Info().Msgf("Got request to delete firewall rule with ID %v", ruleID)
+
+	result := f.db.WithContext(ctx).Where("id = ?", ruleID).Delete(&FirewallRule{})
+	if result.Error != nil {
+		log.Err(result.Error).Msg("Failed to delete firewall rule")
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -12,17 +12,66 @@ type HealthCheck struct {
 	Healthy   int       `gorm:"not null" json:"healthy"`
 	Lag       int       `gorm:"not null" json:"lag"`
 	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+
+	// replication lag in milliseconds and whether the server is a standby,
+	// nil when the health check could not log in
+	ReplicationLag *int `json:"replication_lag"`
+	InRecovery     *int `json:"in_recovery"`
 }
 
 type User struct {
-	ID        uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"id"`
-	Username  string    `gorm:"uniqueIndex;not null" json:"username"`
-	Password  string    `gorm:"not null" json:"password"`
-	IsAdmin   bool      `gorm:"not null" json:"role"` // admin,
-	Role      string
-	CreatedAt time.Time  `gorm:"not null" json:"created_at"`
-	UpdatedAt time.Time  `gorm:"not null" json:"updated_at"`
-	DeletedAt *time.Time `gorm:"not null" json:"deleted_at"`
+	ID       uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()" json:"id"`
+	Username string    `gorm:"uniqueIndex;not null" json:"username"`
+	Password string    `gorm:"not null" json:"password"`
+	// SCRAM-SHA-256 verifier in PostgreSQL's format, for clients logging in with a password
+	ScramVerifier string `gorm:"not null" json:"-"`
+	IsAdmin       bool   `gorm:"not null" json:"role"` // admin,
+	Role          string
+	CreatedAt     time.Time  `gorm:"not null" json:"created_at"`
+	UpdatedAt     time.Time  `gorm:"not null" json:"updated_at"`
+	DeletedAt     *time.Time `gorm:"not null" json:"deleted_at"`
+}
+
+// UpstreamCredential is the database login the proxy uses on behalf of a
+// proxy user, or of every user with a role when ProxyUser is empty
+type UpstreamCredential struct {
+	ID         uuid.UUID `gorm:"primaryKey;type:uuid" json:"id"`
+	ProxyUser  string    `gorm:"not null" json:"proxy_user"`
+	ProxyRole  string    `gorm:"not null" json:"proxy_role"`
+	DBUser     string    `gorm:"column:db_user;not null" json:"db_user"`
+	DBPassword string    `gorm:"column:db_password;not null" json:"-"`
+	CreatedAt  time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt  time.Time `gorm:"not null" json:"updated_at"`
+}
+
+// FirewallRule denies the statements that match every condition it sets, for
+// the proxy user or role it is scoped to, or for everyone when it sets
+// neither. A rule with a maintenance window does not apply during it.
+type FirewallRule struct {
+	ID             uuid.UUID `gorm:"primaryKey;type:uuid" json:"id"`
+	Name           string    `gorm:"not null" json:"name"`
+	ProxyUser      string    `gorm:"not null" json:"proxy_user"`
+	ProxyRole      string    `gorm:"not null" json:"proxy_role"`
+	StatementTypes string    `gorm:"not null" json:"statement_types"` // comma-separated, as in DROP,TRUNCATE
+	Schemas        string    `gorm:"not null" json:"schemas"`         // comma-separated
+	MissingWhere   bool      `gorm:"not null" json:"missing_where"`   // an UPDATE or DELETE without WHERE
+	CopyProgram    bool      `gorm:"not null" json:"copy_program"`    // COPY ... TO or FROM PROGRAM
+	WindowStart    string    `gorm:"not null" json:"window_start"`    // HH:MM in UTC
+	WindowEnd      string    `gorm:"not null" json:"window_end"`
+	CreatedAt      time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt      time.Time `gorm:"not null" json:"updated_at"`
+}
+
+// AllowlistEntry is a query fingerprint a proxy user sent and whether the
+// allowlist lets that user send it
+type AllowlistEntry struct {
+	ID          uuid.UUID `gorm:"primaryKey;type:uuid" json:"id"`
+	ProxyUser   string    `gorm:"not null" json:"proxy_user"`
+	Fingerprint string    `gorm:"not null" json:"fingerprint"`
+	Query       string    `gorm:"not null" json:"query"`  // the normalized statement
+	Status      string    `gorm:"not null" json:"status"` // allowed, pending or revoked
+	CreatedAt   time.Time `gorm:"not null" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"not null" json:"updated_at"`
 }
 
 type Request struct {
@@ -41,6 +90,11 @@ type SQL struct {
 	CreatedAt   time.Time  `gorm:"not null" json:"created_at"`
 	CompletedAt *time.Time `json:"completed_at"`
 	IsRead      bool
+	Rejected    bool       `gorm:"not null" json:"rejected"`
+	Hint        string     `gorm:"not null" json:"hint"`
+	Type        string     `gorm:"not null" json:"type"`
+	Tables      string     `gorm:"not null" json:"tables"`
+	RuleID      *uuid.UUID `gorm:"type:uuid" json:"rule_id"` // the firewall rule that blocked it
 }
 
 type LogEntry struct {
@@ -85,7 +85,7 @@ func (u UserStore) Update(ctx context.Context, requestID uuid.UUID, payload User
 
 	if err := u.db.WithContext(ctx).
 		Model(&User{}).
-		Where("id = ?", requestID).
+		Where("id = ?", payload.ID).
 		Updates(payload).Error; err != nil {
 		log.Err(err).Msg("Failed to update user")
 		return err
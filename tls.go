@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Request codes a client can send in place of a StartupMessage
+const (
+	cancelRequestCode = 80877102
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+)
+
+// newServerTLSConfig builds the TLS configuration offered to clients that send
+// an SSLRequest. It returns nil when no server certificate is configured.
+func newServerTLSConfig(config *Config) (*tls.Config, error) {
+	if config.tlsCertFile == "" || config.tlsKeyFile == "" {
+		if config.tlsRequired {
+			return nil, fmt.Errorf("TLS_REQUIRED is set but TLS_CERT_FILE and TLS_KEY_FILE are not")
+		}
+
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.tlsCertFile, config.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.tlsClientCAFile != "" {
+		pool, err := loadCertPool(config.tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if config.tlsRequireClientCert {
+		if tlsConfig.ClientCAs == nil {
+			return nil, fmt.Errorf("TLS_REQUIRE_CLIENT_CERT is set but TLS_CLIENT_CA_FILE is not")
+		}
+
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// newUpstreamTLSConfig builds the TLS configuration used to connect to an
+// upstream server. It returns nil when sslmode is disable or unset.
+func newUpstreamTLSConfig(upstream UpstreamConfig) (*tls.Config, error) {
+	mode := upstream.sslMode
+
+	switch mode {
+	case "", "disable":
+		return nil, nil
+	case "require":
+		// like libpq, require with a CA bundle also verifies the chain
+		if upstream.sslRootCert != "" {
+			mode = "verify-ca"
+		}
+	case "verify-ca", "verify-full":
+	default:
+		return nil, fmt.Errorf("unknown sslmode %q", mode)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if upstream.sslCert != "" || upstream.sslKey != "" {
+		cert, err := tls.LoadX509KeyPair(upstream.sslCert, upstream.sslKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// without a CA bundle the system roots are used
+	var roots *x509.CertPool
+	if upstream.sslRootCert != "" {
+		pool, err := loadCertPool(upstream.sslRootCert)
+		if err != nil {
+			return nil, err
+		}
+
+		roots = pool
+	}
+
+	switch mode {
+	case "require":
+		tlsConfig.InsecureSkipVerify = true
+	case "verify-ca":
+		// the chain is checked but the host name is not
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("server sent no certificate")
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+
+			return err
+		}
+	case "verify-full":
+		host, _, err := net.SplitHostPort(upstream.addr)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = roots
+		tlsConfig.ServerName = host
+	}
+
+	return tlsConfig, nil
+}
+
+// dialUpstream connects to an upstream server, negotiating TLS with an
+// SSLRequest first when tlsConfig is set.
+func dialUpstream(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		return conn, nil
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], sslRequestCode)
+
+	if _, err = conn.Write(request); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	answer := make([]byte, 1)
+	if _, err = io.ReadFull(conn, answer); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if answer[0] != 'S' {
+		_ = conn.Close()
+		return nil, fmt.Errorf("server %s does not accept SSL connections", addr)
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	if err = tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", addr, err)
+	}
+
+	if err = tlsConn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s: %w", file, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return pool, nil
+}
+
+// readStartup reads the client's StartupMessage or CancelRequest, first
+// answering the SSLRequest and GSSENCRequest packets that may precede it. When
+// TLS is accepted request.conn is replaced by the TLS connection.
+func (p *Proxy) readStartup(request *Request) ([]byte, error) {
+	for {
+		msg, err := readStartupMessage(request.conn)
+		if err != nil {
+			return nil, err
+		}
+
+		_, isTLS := request.conn.(*tls.Conn)
+
+		switch binary.BigEndian.Uint32(msg[4:8]) {
+		case sslRequestCode:
+			if isTLS {
+				return nil, fmt.Errorf("SSLRequest received on an encrypted connection")
+			}
+
+			if p.tlsConfig == nil {
+				if _, err = request.conn.Write([]byte{'N'}); err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			if _, err = request.conn.Write([]byte{'S'}); err != nil {
+				return nil, err
+			}
+
+			tlsConn := tls.Server(request.conn, p.tlsConfig)
+
+			if err = tlsConn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+				return nil, err
+			}
+
+			if err = tlsConn.Handshake(); err != nil {
+				return nil, fmt.Errorf("TLS handshake failed: %w", err)
+			}
+
+			if err = tlsConn.SetDeadline(time.Time{}); err != nil {
+				return nil, err
+			}
+
+			request.conn = tlsConn
+		case gssEncRequestCode:
+			// GSSAPI encryption is not supported; the client falls back
+			if _, err = request.conn.Write([]byte{'N'}); err != nil {
+				return nil, err
+			}
+		case cancelRequestCode:
+			// cancel requests carry no credentials and are never encrypted
+			return msg, nil
+		default:
+			if p.config.tlsRequired && !isTLS {
+				_ = writeError(request.conn, "FATAL", "28000", "SSL connection is required")
+				return nil, fmt.Errorf("plaintext connection refused, TLS is required")
+			}
+
+			return msg, nil
+		}
+	}
+}